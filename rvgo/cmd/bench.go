@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/urfave/cli/v2"
+
+	"github.com/ethereum-optimism/optimism/op-service/jsonutil"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+var (
+	BenchPathFlag = &cli.StringSliceFlag{
+		Name:  "path",
+		Usage: "ELF binary, or directory of ELF binaries, to benchmark. Can be repeated.",
+		Value: cli.NewStringSlice("tests/riscv-tests/benchmarks", "tests/go-tests/bin"),
+	}
+	BenchOutputFlag = &cli.PathFlag{
+		Name:      "output",
+		Usage:     "path of output JSON benchmark report. Not written if empty, use - to write to Stdout.",
+		TakesFile: true,
+		Value:     "bench.json",
+	}
+	BenchMaxStepsFlag = &cli.Uint64Flag{
+		Name:  "max-steps",
+		Usage: "maximum number of steps to run each binary for, before reporting it as unfinished.",
+		Value: 100_000_000,
+	}
+	BenchProofStepsFlag = &cli.Uint64Flag{
+		Name:  "proof-steps",
+		Usage: "number of steps, from the start of each binary, to generate proofs for to measure proof-generation cost.",
+		Value: 1000,
+	}
+)
+
+const (
+	BenchStatusExited      = "exited"
+	BenchStatusStepLimit   = "step-limit"
+	BenchStatusStuck       = "stuck"
+	BenchStatusUnsupported = "unsupported"
+	BenchStatusLoadFailed  = "load-failed"
+)
+
+// BenchResult summarizes the fast-VM execution of a single ELF binary.
+// Durations are in nanoseconds, to keep the report easy to diff between releases.
+type BenchResult struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	ExitCode uint8  `json:"exit-code"`
+	Steps    uint64 `json:"steps"`
+	PC       uint64 `json:"pc"`
+
+	RunTime               int64   `json:"run-time-ns"`
+	InstructionsPerSecond float64 `json:"ips"`
+	Pages                 int     `json:"pages"`
+	MerkleRootTime        int64   `json:"merkle-root-time-ns"`
+	ProofSteps            uint64  `json:"proof-steps"`
+	ProofTimePerStep      int64   `json:"proof-time-per-step-ns"`
+	ProofBytesPerStep     uint64  `json:"proof-bytes-per-step"`
+}
+
+type BenchReport struct {
+	GoVersion string        `json:"go-version"`
+	Time      time.Time     `json:"time"`
+	Results   []BenchResult `json:"results"`
+}
+
+// benchOracle is used for guests that request pre-images during a benchmark: there is no pre-image server to serve them.
+type benchOracle struct{}
+
+func (benchOracle) Hint(v []byte) {}
+
+func (benchOracle) GetPreimage(k [32]byte) []byte {
+	panic(fmt.Errorf("no pre-image oracle available in benchmark, cannot serve key %x", k))
+}
+
+var _ fast.PreimageOracle = benchOracle{}
+
+// benchFiles expands the given paths into the list of ELF binaries to benchmark.
+// Files in directories are filtered, files that are listed explicitly are always benchmarked.
+func benchFiles(paths []string) ([]string, error) {
+	var out []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot benchmark %q: %w", p, err)
+		}
+		if !info.IsDir() {
+			out = append(out, p)
+			continue
+		}
+		items, err := os.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read benchmark dir %q: %w", p, err)
+		}
+		for _, item := range items {
+			if item.IsDir() || strings.HasSuffix(item.Name(), ".dump") {
+				continue
+			}
+			out = append(out, filepath.Join(p, item.Name()))
+		}
+	}
+	return out, nil
+}
+
+func loadBenchELF(path string) (*fast.VMState, uint64, error) {
+	elfProgram, err := elf.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open ELF file %q: %w", path, err)
+	}
+	defer elfProgram.Close()
+	if elfProgram.Machine != elf.EM_RISCV {
+		return nil, 0, fmt.Errorf("ELF is not RISC-V, but got %q", elfProgram.Machine.String())
+	}
+	state, err := fast.LoadELF(elfProgram)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load ELF data into VM state: %w", err)
+	}
+	// Go guests need the runtime patches and initial stack, like load-elf applies.
+	if elfProgram.Section(".go.buildinfo") != nil {
+		if err := fast.PatchVM(elfProgram, state); err != nil {
+			return nil, 0, fmt.Errorf("failed to patch VM: %w", err)
+		}
+	}
+	// riscv-tests report completion through the HTIF "tohost" symbol, rather than an exit syscall.
+	var tohost uint64
+	if syms, err := elfProgram.Symbols(); err == nil {
+		for _, s := range syms {
+			if s.Name == "tohost" {
+				tohost = s.Value
+				break
+			}
+		}
+	}
+	return state, tohost, nil
+}
+
+func benchELF(ctx *cli.Context, path string, maxSteps uint64, proofSteps uint64, decodeCache bool) BenchResult {
+	res := BenchResult{Name: filepath.Base(path), Path: path}
+
+	state, tohost, err := loadBenchELF(path)
+	if err != nil {
+		res.Status = BenchStatusLoadFailed
+		res.Error = err.Error()
+		return res
+	}
+
+	us := fast.NewInstrumentedState(state, benchOracle{}, io.Discard, io.Discard)
+	us.SetDecodeCache(decodeCache)
+	start := time.Now()
+	for {
+		if state.Exited {
+			res.Status = BenchStatusExited
+			res.ExitCode = state.ExitCode
+			break
+		}
+		if state.Step >= maxSteps {
+			res.Status = BenchStatusStepLimit
+			break
+		}
+		if state.Step%100_000 == 0 {
+			if ctx.Context.Err() != nil {
+				break // interrupted, the result is discarded
+			}
+		}
+		pc := state.PC
+		if _, err := us.Step(false); err != nil {
+			res.Status = BenchStatusUnsupported
+			res.Error = fmt.Sprintf("failed at step %d (PC: %08x): %v", state.Step, pc, err)
+			break
+		}
+		// A jump to itself never makes progress: this is how bare-metal programs halt.
+		if state.PC == pc && !state.Exited {
+			res.Status = BenchStatusStuck
+			res.Error = fmt.Sprintf("spinning at PC %08x", pc)
+			if tohost != 0 {
+				var dat [8]byte
+				state.Memory.GetUnaligned(tohost, dat[:])
+				v := binary.LittleEndian.Uint64(dat[:])
+				if v&1 == 1 { // HTIF exit command: the exit code is in the upper bits
+					res.Status = BenchStatusExited
+					res.Error = ""
+					res.ExitCode = uint8(v >> 1)
+				} else {
+					res.Error = fmt.Sprintf("spinning at PC %08x, waiting on unsupported HTIF tohost command %x", pc, v)
+				}
+			}
+			break
+		}
+	}
+	runTime := time.Since(start)
+	res.Steps = state.Step
+	res.PC = state.PC
+	res.RunTime = runTime.Nanoseconds()
+	if runTime > 0 {
+		res.InstructionsPerSecond = float64(state.Step) / runTime.Seconds()
+	}
+	res.Pages = state.Memory.PageCount()
+
+	// The memory was never merkleized during the run, so this is a full (cold) merkleization.
+	start = time.Now()
+	_ = state.Memory.MerkleRoot()
+	res.MerkleRootTime = time.Since(start).Nanoseconds()
+
+	// Proof generation is measured separately, from a fresh state, since it is much slower than plain execution.
+	proofState, _, err := loadBenchELF(path)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	proofUs := fast.NewInstrumentedState(proofState, benchOracle{}, io.Discard, io.Discard)
+	var proofBytes uint64
+	start = time.Now()
+	for res.ProofSteps < proofSteps && !proofState.Exited {
+		wit, err := proofUs.Step(true)
+		if err != nil {
+			break
+		}
+		proofBytes += uint64(len(wit.MemProof))
+		res.ProofSteps++
+	}
+	if res.ProofSteps > 0 {
+		res.ProofTimePerStep = time.Since(start).Nanoseconds() / int64(res.ProofSteps)
+		res.ProofBytesPerStep = proofBytes / res.ProofSteps
+	}
+	return res
+}
+
+func Bench(ctx *cli.Context) error {
+	l := Logger(os.Stderr, log.LevelInfo)
+
+	files, err := benchFiles(ctx.StringSlice(BenchPathFlag.Name))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no binaries to benchmark")
+	}
+
+	maxSteps := ctx.Uint64(BenchMaxStepsFlag.Name)
+	proofSteps := ctx.Uint64(BenchProofStepsFlag.Name)
+
+	report := &BenchReport{
+		GoVersion: runtime.Version(),
+		Time:      time.Now(),
+	}
+	for _, path := range files {
+		res := benchELF(ctx, path, maxSteps, proofSteps, ctx.Bool(RunDecodeCacheFlag.Name))
+		if err := ctx.Context.Err(); err != nil {
+			return err
+		}
+		if res.Status == BenchStatusExited {
+			l.Info("benchmarked",
+				"name", res.Name,
+				"exit", res.ExitCode,
+				"steps", res.Steps,
+				"ips", res.InstructionsPerSecond,
+				"pages", res.Pages,
+				"merkle_root_time", time.Duration(res.MerkleRootTime),
+				"proof_time_per_step", time.Duration(res.ProofTimePerStep),
+			)
+		} else {
+			l.Warn("benchmark did not complete",
+				"name", res.Name,
+				"status", res.Status,
+				"steps", res.Steps,
+				"pc", HexU32(res.PC),
+				"err", res.Error,
+			)
+		}
+		report.Results = append(report.Results, res)
+	}
+
+	if err := jsonutil.WriteJSON(ctx.Path(BenchOutputFlag.Name), report, OutFilePerm); err != nil {
+		return fmt.Errorf("failed to write benchmark report: %w", err)
+	}
+	return nil
+}
+
+var BenchCommand = &cli.Command{
+	Name:        "bench",
+	Usage:       "Benchmark the fast VM on a set of ELF binaries.",
+	Description: "Run each ELF binary on the fast VM to completion, and report execution speed, memory usage, merkleization and proof-generation cost.",
+	Action:      Bench,
+	Flags: []cli.Flag{
+		BenchPathFlag,
+		BenchOutputFlag,
+		BenchMaxStepsFlag,
+		BenchProofStepsFlag,
+		RunDecodeCacheFlag,
+	},
+}
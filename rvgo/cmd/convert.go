@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ConvertInputFlag = &cli.PathFlag{
+		Name:      "input",
+		Usage:     "path of input state. Binary if the path ends with .bin or .bin.gz, JSON otherwise.",
+		TakesFile: true,
+		Required:  true,
+	}
+	ConvertOutputFlag = &cli.PathFlag{
+		Name:      "output",
+		Usage:     "path of output state. Binary if the path ends with .bin or .bin.gz, JSON otherwise. Use - to write to Stdout.",
+		TakesFile: true,
+		Required:  true,
+	}
+)
+
+func Convert(ctx *cli.Context) error {
+	input := ctx.Path(ConvertInputFlag.Name)
+	output := ctx.Path(ConvertOutputFlag.Name)
+	state, err := LoadState(input)
+	if err != nil {
+		return fmt.Errorf("invalid input state (%v): %w", input, err)
+	}
+	if err := WriteState(output, state, ctx.Bool(RunMerkleCacheFlag.Name)); err != nil {
+		return fmt.Errorf("failed to write output state: %w", err)
+	}
+	return nil
+}
+
+var ConvertCommand = &cli.Command{
+	Name:        "convert",
+	Usage:       "Convert an Asterisc state between the JSON and binary formats",
+	Description: "Convert an Asterisc state between the JSON and binary formats, selected by file extension. Delta states are converted into full states.",
+	Action:      Convert,
+	Flags: []cli.Flag{
+		ConvertInputFlag,
+		ConvertOutputFlag,
+		RunMerkleCacheFlag,
+	},
+}
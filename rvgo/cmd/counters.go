@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/ethereum-optimism/optimism/op-service/jsonutil"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+var CountersInputFlag = &cli.StringSliceFlag{
+	Name:     "input",
+	Usage:    "path of a counters file, as written by run --counters. Repeat the flag to merge the counts of multiple runs.",
+	Required: true,
+}
+
+// opcodeNames are the names of the RISC-V major opcodes, as used in the spec.
+var opcodeNames = map[uint8]string{
+	0x03: "LOAD",
+	0x0F: "MISC-MEM",
+	0x13: "OP-IMM",
+	0x17: "AUIPC",
+	0x1B: "OP-IMM-32",
+	0x23: "STORE",
+	0x2F: "AMO",
+	0x33: "OP",
+	0x37: "LUI",
+	0x3B: "OP-32",
+	0x63: "BRANCH",
+	0x67: "JALR",
+	0x6F: "JAL",
+	0x73: "SYSTEM",
+}
+
+func opcodeName(opcode uint8) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// WriteCountersReport writes the counts as text tables, most frequent first, with the share of the total of each table.
+func WriteCountersReport(w io.Writer, c *fast.Counters) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	instrs := c.Instructions()
+	var total uint64
+	for _, ic := range instrs {
+		total += ic.Count
+	}
+	fmt.Fprintln(tw, "opcode\tname\tfunct3\tfunct7\tcount\tshare\t")
+	for _, ic := range instrs {
+		fmt.Fprintf(tw, "0x%02x\t%s\t%d\t0x%02x\t%d\t%.2f%%\t\n", ic.Opcode, opcodeName(ic.Opcode), ic.Funct3, ic.Funct7, ic.Count, share(ic.Count, total))
+	}
+	fmt.Fprintln(tw)
+
+	syscalls := c.Syscalls()
+	total = 0
+	for _, sc := range syscalls {
+		total += sc.Count
+	}
+	fmt.Fprintln(tw, "syscall\tname\tcount\tshare\t")
+	for _, sc := range syscalls {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%.2f%%\t\n", sc.Num, fast.SyscallName(sc.Num), sc.Count, share(sc.Count, total))
+	}
+	fmt.Fprintln(tw)
+
+	patterns := c.ProofPatterns()
+	total = 0
+	for _, pc := range patterns {
+		total += pc.Count
+	}
+	fmt.Fprintln(tw, "proof pattern\tcount\tshare\t")
+	for _, pc := range patterns {
+		pattern := pc.Pattern
+		if pattern == "" {
+			pattern = "(none)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.2f%%\t\n", pattern, pc.Count, share(pc.Count, total))
+	}
+	return tw.Flush()
+}
+
+func share(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func CountersReport(ctx *cli.Context) error {
+	counters := fast.NewCounters()
+	for _, path := range ctx.StringSlice(CountersInputFlag.Name) {
+		c, err := jsonutil.LoadJSON[fast.Counters](path)
+		if err != nil {
+			return fmt.Errorf("failed to load counters: %w", err)
+		}
+		counters.Merge(c)
+	}
+	return WriteCountersReport(os.Stdout, counters)
+}
+
+var CountersCommand = &cli.Command{
+	Name:        "counters",
+	Usage:       "Report the VM code paths that runs executed",
+	Description: "Report the instruction encodings, syscalls and memory proof patterns that runs executed, as counted with run --counters. The counts of multiple runs are merged.",
+	Action:      CountersReport,
+	Flags: []cli.Flag{
+		CountersInputFlag,
+	},
+}
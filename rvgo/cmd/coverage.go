@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bufio"
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/ethereum-optimism/optimism/op-service/ioutil"
+	"github.com/ethereum-optimism/optimism/op-service/jsonutil"
+)
+
+// instrSize is the size of a RISC-V instruction. Compressed instructions are not supported.
+const instrSize = 4
+
+// Coverage is the guest code coverage of a run, as written to the --coverage file.
+type Coverage struct {
+	Functions []FunctionCoverage `json:"functions"`
+	// Lines are only available if the program has DWARF line info.
+	Lines []LineCoverage `json:"lines,omitempty"`
+}
+
+type FunctionCoverage struct {
+	Name  string `json:"name"`
+	Start uint64 `json:"start"`
+	Size  uint64 `json:"size"`
+	// Instructions is the number of instructions of the function, and Covered the number of those that executed.
+	Instructions uint64 `json:"instructions"`
+	Covered      uint64 `json:"covered"`
+	// Hits is the number of steps executed within the function.
+	Hits uint64 `json:"hits"`
+}
+
+type LineCoverage struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	// Hits is the highest execution count of the instructions of the line, 0 if none of them executed.
+	Hits uint64 `json:"hits"`
+}
+
+// MakeCoverage computes the coverage of the executed PCs, with their execution counts.
+// If the ELF program is available, functions are read from its symbol table, and lines from its DWARF data, if any.
+// Otherwise functions are read from the metadata symbols, which do not distinguish code from data:
+// only the symbols with executed instructions are included then.
+func MakeCoverage(hits map[uint64]uint64, meta *Metadata, elfProgram *elf.File) (*Coverage, error) {
+	symbols := meta.Symbols
+	onlyHit := true
+	if elfProgram != nil {
+		syms, err := elfProgram.Symbols()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load symbols table: %w", err)
+		}
+		symbols = nil
+		for _, s := range syms {
+			if elf.ST_TYPE(s.Info) == elf.STT_FUNC {
+				symbols = append(symbols, Symbol{Name: s.Name, Start: s.Value, Size: s.Size})
+			}
+		}
+		onlyHit = false
+	}
+
+	out := &Coverage{}
+	for _, s := range symbols {
+		if s.Size == 0 {
+			continue
+		}
+		f := FunctionCoverage{Name: s.Name, Start: s.Start, Size: s.Size, Instructions: s.Size / instrSize}
+		for pc := s.Start; pc < s.Start+s.Size; pc += instrSize {
+			if n := hits[pc]; n > 0 {
+				f.Covered++
+				f.Hits += n
+			}
+		}
+		if onlyHit && f.Covered == 0 {
+			continue
+		}
+		out.Functions = append(out.Functions, f)
+	}
+	sort.Slice(out.Functions, func(i, j int) bool {
+		return out.Functions[i].Start < out.Functions[j].Start
+	})
+
+	if elfProgram == nil {
+		return out, nil
+	}
+	dw, err := elfProgram.DWARF()
+	if err != nil {
+		// no DWARF data, e.g. a stripped binary
+		return out, nil
+	}
+	lines, err := lineCoverage(hits, dw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DWARF line info: %w", err)
+	}
+	out.Lines = lines
+	return out, nil
+}
+
+type fileLine struct {
+	file string
+	line int
+}
+
+func lineCoverage(hits map[uint64]uint64, dw *dwarf.Data) ([]LineCoverage, error) {
+	lines := make(map[fileLine]uint64)
+	r := dw.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if cu == nil {
+			break
+		}
+		if cu.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		lr, err := dw.LineReader(cu)
+		if err != nil {
+			return nil, err
+		}
+		r.SkipChildren()
+		if lr == nil {
+			continue
+		}
+		// each entry covers the instructions up to the address of the next entry
+		var prev dwarf.LineEntry
+		hasPrev := false
+		for {
+			var entry dwarf.LineEntry
+			if err := lr.Next(&entry); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if hasPrev && prev.File != nil && prev.Line > 0 {
+				key := fileLine{file: prev.File.Name, line: prev.Line}
+				n := lines[key]
+				for pc := prev.Address; pc < entry.Address; pc += instrSize {
+					n = max(n, hits[pc])
+				}
+				lines[key] = n
+			}
+			prev, hasPrev = entry, !entry.EndSequence
+		}
+	}
+	out := make([]LineCoverage, 0, len(lines))
+	for k, n := range lines {
+		out = append(out, LineCoverage{File: k.file, Line: k.line, Hits: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].File != out[j].File {
+			return out[i].File < out[j].File
+		}
+		return out[i].Line < out[j].Line
+	})
+	return out, nil
+}
+
+// WriteGoProfile writes the line coverage in the format of a Go coverage profile, in count mode,
+// with a block per source line, so it can be inspected with "go tool cover".
+// Only Go source files are included: the Go tools cannot parse the assembly sources of the runtime.
+func (c *Coverage) WriteGoProfile(w io.Writer) error {
+	if len(c.Lines) == 0 {
+		return errors.New("no line coverage, the program has no DWARF line info")
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintln(bw, "mode: count"); err != nil {
+		return err
+	}
+	for _, l := range c.Lines {
+		if !strings.HasSuffix(l.File, ".go") {
+			continue
+		}
+		// a block from the start of the line to the start of the next line
+		if _, err := fmt.Fprintf(bw, "%s:%d.1,%d.1 1 %d\n", l.File, l.Line, l.Line+1, l.Hits); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+var (
+	CoverageInputFlag = &cli.PathFlag{
+		Name:      "input",
+		Usage:     "path of the coverage report, as written by run --coverage",
+		TakesFile: true,
+		Required:  true,
+	}
+	CoverageOutputFlag = &cli.PathFlag{
+		Name:      "output",
+		Usage:     "path to write the Go coverage profile to. Use - to write to Stdout.",
+		TakesFile: true,
+		Value:     "-",
+	}
+)
+
+func CoverageProfile(ctx *cli.Context) error {
+	cov, err := jsonutil.LoadJSON[Coverage](ctx.Path(CoverageInputFlag.Name))
+	if err != nil {
+		return fmt.Errorf("failed to load coverage report: %w", err)
+	}
+	outPath := ctx.Path(CoverageOutputFlag.Name)
+	if outPath == "-" {
+		return cov.WriteGoProfile(os.Stdout)
+	}
+	f, err := ioutil.NewAtomicWriterCompressed(outPath, OutFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to open output file: %w", err)
+	}
+	defer f.Close()
+	if err := cov.WriteGoProfile(f); err != nil {
+		return fmt.Errorf("failed to write coverage profile: %w", err)
+	}
+	return f.Close()
+}
+
+var CoverageCommand = &cli.Command{
+	Name:        "coverage",
+	Usage:       "Convert a guest coverage report into a Go coverage profile",
+	Description: "Convert the line coverage of a guest coverage report, as written by run --coverage, into a Go coverage profile, to inspect with \"go tool cover -func\" or \"go tool cover -html\".",
+	Action:      CoverageProfile,
+	Flags: []cli.Flag{
+		CoverageInputFlag,
+		CoverageOutputFlag,
+	},
+}
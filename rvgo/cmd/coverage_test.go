@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const coverageTestProgram = `package main
+
+var verbose bool
+
+func add(a, b int) int {
+	return a + b
+}
+
+func notCalled() int {
+	return 1
+}
+
+func main() {
+	if verbose {
+		println(notCalled())
+	}
+	println(add(1, 2))
+}
+`
+
+// buildCoverageTestProgram builds the coverage test program, with DWARF line info,
+// and returns the path of the source file and the ELF program.
+// It is built for arm64, which has fixed 4-byte instructions like the guest programs with any Go toolchain:
+// recent toolchains emit compressed instructions for riscv64 by default.
+func buildCoverageTestProgram(t *testing.T) (string, *elf.File) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.go")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module covtest\n\ngo 1.21\n"), 0644))
+	require.NoError(t, os.WriteFile(src, []byte(coverageTestProgram), 0644))
+	// without optimizations and inlining, every function and line keeps its own instructions
+	cmd := exec.Command("go", "build", "-gcflags=-N -l", "-o", "prog", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GOARCH=arm64", "GOFLAGS=")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "build: %s", out)
+	f, err := elf.Open(filepath.Join(dir, "prog"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+	return src, f
+}
+
+func TestCoverage(t *testing.T) {
+	src, elfProgram := buildCoverageTestProgram(t)
+	syms, err := elfProgram.Symbols()
+	require.NoError(t, err)
+	symbol := func(name string) Symbol {
+		for _, s := range syms {
+			if s.Name == name {
+				return Symbol{Name: s.Name, Start: s.Value, Size: s.Size}
+			}
+		}
+		t.Fatalf("symbol %s not found", name)
+		return Symbol{}
+	}
+	add, notCalled, mainFn := symbol("main.add"), symbol("main.notCalled"), symbol("main.main")
+
+	// every instruction of add executes 3 times, and the first instruction of main once
+	hits := map[uint64]uint64{mainFn.Start: 1}
+	for pc := add.Start; pc < add.Start+add.Size; pc += instrSize {
+		hits[pc] = 3
+	}
+
+	t.Run("functions and lines", func(t *testing.T) {
+		cov, err := MakeCoverage(hits, &Metadata{}, elfProgram)
+		require.NoError(t, err)
+		functions := make(map[string]FunctionCoverage)
+		for _, f := range cov.Functions {
+			functions[f.Name] = f
+		}
+		require.Equal(t, FunctionCoverage{
+			Name:         "main.add",
+			Start:        add.Start,
+			Size:         add.Size,
+			Instructions: add.Size / instrSize,
+			Covered:      add.Size / instrSize,
+			Hits:         3 * add.Size / instrSize,
+		}, functions["main.add"])
+		require.Equal(t, notCalled.Size/instrSize, functions["main.notCalled"].Instructions)
+		require.Zero(t, functions["main.notCalled"].Covered, "functions without hits are included with the ELF program")
+		require.Equal(t, uint64(1), functions["main.main"].Covered)
+		require.Equal(t, uint64(1), functions["main.main"].Hits)
+
+		lines := make(map[int]uint64)
+		for _, l := range cov.Lines {
+			if l.File == src {
+				lines[l.Line] = l.Hits
+			}
+		}
+		require.Equal(t, uint64(3), lines[5], "func add")
+		require.Equal(t, uint64(3), lines[6], "return a + b")
+		require.Contains(t, lines, 10, "return 1")
+		require.Zero(t, lines[10])
+		require.Equal(t, uint64(1), lines[13], "func main")
+
+		// the profile of the program source is accepted by the Go tools
+		var profile bytes.Buffer
+		srcOnly := &Coverage{}
+		for _, l := range cov.Lines {
+			if l.File == src {
+				srcOnly.Lines = append(srcOnly.Lines, l)
+			}
+		}
+		require.NoError(t, srcOnly.WriteGoProfile(&profile))
+		require.True(t, strings.HasPrefix(profile.String(), "mode: count\n"))
+		require.Contains(t, profile.String(), src+":6.1,7.1 1 3\n")
+		profilePath := filepath.Join(t.TempDir(), "cover.out")
+		require.NoError(t, os.WriteFile(profilePath, profile.Bytes(), 0644))
+		out, err := exec.Command("go", "tool", "cover", "-func="+profilePath).CombinedOutput()
+		require.NoError(t, err, "go tool cover: %s", out)
+		report := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			fields := strings.Fields(line)
+			require.Len(t, fields, 3, line)
+			report[fields[1]] = fields[2]
+		}
+		require.Equal(t, "100.0%", report["add"])
+		require.Equal(t, "0.0%", report["notCalled"])
+	})
+
+	t.Run("metadata symbols", func(t *testing.T) {
+		// without the ELF program, only the metadata symbols with hits are included, and there are no lines
+		meta := &Metadata{Symbols: []Symbol{mainFn, notCalled, add}}
+		cov, err := MakeCoverage(hits, meta, nil)
+		require.NoError(t, err)
+		require.Len(t, cov.Functions, 2)
+		require.Equal(t, "main.add", cov.Functions[0].Name, "sorted by address")
+		require.Equal(t, "main.main", cov.Functions[1].Name)
+		require.Empty(t, cov.Lines)
+		require.ErrorContains(t, cov.WriteGoProfile(new(bytes.Buffer)), "no line coverage")
+	})
+}
@@ -34,13 +34,13 @@ func LoadELF(ctx *cli.Context) error {
 	if err := jsonutil.WriteJSON[*Metadata](ctx.Path(cannon.LoadELFMetaFlag.Name), meta, OutFilePerm); err != nil {
 		return fmt.Errorf("failed to output metadata: %w", err)
 	}
-	return jsonutil.WriteJSON[*fast.VMState](ctx.Path(cannon.LoadELFOutFlag.Name), state, OutFilePerm)
+	return WriteState(ctx.Path(cannon.LoadELFOutFlag.Name), state, false)
 }
 
 var LoadELFCommand = &cli.Command{
 	Name:        "load-elf",
-	Usage:       "Load ELF file into Asterisc JSON state",
-	Description: "Load ELF file into Asterisc JSON state, optionally patch out functions",
+	Usage:       "Load ELF file into Asterisc JSON or binary state",
+	Description: "Load ELF file into Asterisc JSON or binary state, optionally patch out functions. The state is binary if the output path ends with .bin or .bin.gz",
 	Action:      LoadELF,
 	Flags: []cli.Flag{
 		cannon.LoadELFPathFlag,
@@ -51,3 +51,14 @@ func (v HexU32) String() string {
 func (v HexU32) MarshalText() ([]byte, error) {
 	return []byte(v.String()), nil
 }
+
+// HexU64 to lazy-format 64-bit integer attributes for logging
+type HexU64 uint64
+
+func (v HexU64) String() string {
+	return fmt.Sprintf("%016x", uint64(v))
+}
+
+func (v HexU64) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
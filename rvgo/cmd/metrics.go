@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ethereum-optimism/optimism/op-service/httputil"
+	opmetrics "github.com/ethereum-optimism/optimism/op-service/metrics"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+const metricsNamespace = "asterisc"
+
+// RunMetrics are the Prometheus metrics of a run.
+// All methods are no-ops on a nil *RunMetrics, so runs without a metrics server do not record anything.
+type RunMetrics struct {
+	step          prometheus.Gauge
+	stepsExecuted prometheus.Counter
+	ips           prometheus.Gauge
+	pages         prometheus.Gauge
+	exited        prometheus.Gauge
+
+	preimageRequests *prometheus.CounterVec
+	preimageBytes    *prometheus.CounterVec
+	preimageLatency  *prometheus.HistogramVec
+	hints            prometheus.Counter
+
+	snapshotDuration prometheus.Histogram
+	proofDuration    prometheus.Histogram
+
+	lastStep uint64
+	lastTime time.Time
+}
+
+func NewRunMetrics(registry *prometheus.Registry) *RunMetrics {
+	factory := opmetrics.With(registry)
+	return &RunMetrics{
+		step: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "step",
+			Help:      "Current step of the VM",
+		}),
+		stepsExecuted: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "steps_executed_total",
+			Help:      "Number of steps executed by this run",
+		}),
+		ips: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "instructions_per_second",
+			Help:      "Recent number of instructions executed per second",
+		}),
+		pages: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "memory_pages",
+			Help:      "Number of allocated memory pages of the VM",
+		}),
+		exited: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "exited",
+			Help:      "1 if the program has exited, 0 otherwise",
+		}),
+		preimageRequests: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "preimage_requests_total",
+			Help:      "Number of pre-images fetched from the pre-image server, by key type",
+		}, []string{"type"}),
+		preimageBytes: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "preimage_bytes_total",
+			Help:      "Number of pre-image bytes fetched from the pre-image server, by key type",
+		}, []string{"type"}),
+		preimageLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "preimage_request_seconds",
+			Help:      "Duration of pre-image fetches from the pre-image server, by key type",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"type"}),
+		hints: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "hints_total",
+			Help:      "Number of hints sent to the pre-image server",
+		}),
+		snapshotDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "snapshot_write_seconds",
+			Help:      "Duration of writing a state snapshot",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		proofDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "proof_write_seconds",
+			Help:      "Duration of generating and writing a step proof",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+	}
+}
+
+// StartMetricsServer starts serving the metrics of the registry over HTTP, at the given host:port address.
+func StartMetricsServer(registry *prometheus.Registry, addr string) (*httputil.HTTPServer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics port %q: %w", portStr, err)
+	}
+	return opmetrics.StartServer(registry, host, port)
+}
+
+// RecordProgress records the position of the VM. The instructions per second are computed
+// over the steps since the previous call, so it should be called at regular step intervals.
+func (m *RunMetrics) RecordProgress(state *fast.VMState) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	if !m.lastTime.IsZero() && state.Step >= m.lastStep {
+		steps := state.Step - m.lastStep
+		m.stepsExecuted.Add(float64(steps))
+		if elapsed := now.Sub(m.lastTime); elapsed > 0 {
+			m.ips.Set(float64(steps) / elapsed.Seconds())
+		}
+	}
+	m.lastStep = state.Step
+	m.lastTime = now
+	m.step.Set(float64(state.Step))
+	m.pages.Set(float64(state.Memory.PageCount()))
+	if state.Exited {
+		m.exited.Set(1)
+	} else {
+		m.exited.Set(0)
+	}
+}
+
+func (m *RunMetrics) RecordSnapshot(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.snapshotDuration.Observe(d.Seconds())
+}
+
+func (m *RunMetrics) RecordProof(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.proofDuration.Observe(d.Seconds())
+}
+
+// metricsOracle wraps a pre-image oracle, to record the pre-image fetches and hints of a run.
+type metricsOracle struct {
+	fast.PreimageOracle
+	m *RunMetrics
+}
+
+var _ fast.PreimageOracle = (*metricsOracle)(nil)
+
+func (o *metricsOracle) Hint(v []byte) {
+	o.m.hints.Inc()
+	o.PreimageOracle.Hint(v)
+}
+
+func (o *metricsOracle) GetPreimage(k [32]byte) []byte {
+	start := time.Now()
+	v := o.PreimageOracle.GetPreimage(k)
+	typ := preimageKeyTypeName(k[0])
+	o.m.preimageLatency.WithLabelValues(typ).Observe(time.Since(start).Seconds())
+	o.m.preimageRequests.WithLabelValues(typ).Inc()
+	o.m.preimageBytes.WithLabelValues(typ).Add(float64(len(v)))
+	return v
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+const (
+	// maxPanicMessage is the maximum number of bytes of a guest panic message to decode
+	maxPanicMessage = 1000
+	// maxBacktraceFrames is the maximum number of frames of a guest panic backtrace
+	maxBacktraceFrames = 32
+	// maxStackScan is the maximum number of bytes of the goroutine stack to scan for return addresses
+	maxStackScan = 64 << 10
+
+	// Go ABI details of riscv64, to decode panics
+	regRA = 1
+	regSP = 2
+	regA0 = 10
+	regA1 = 11
+	// regG holds the current goroutine, its stack bounds are the first fields
+	regG = 27
+	// typeKindOffset is the offset of the kind byte in the runtime type of a Go value
+	typeKindOffset = 23
+	typeKindMask   = 0x1f
+	typeKindPtr    = 22
+	typeKindString = 24
+)
+
+// GuestPanic is a Go panic or fatal error of the guest program, detected on entry of the runtime function that handles it.
+type GuestPanic struct {
+	// Kind is the runtime function that was entered: "throw", "fatal", "gopanic" or "fatalpanic".
+	// A gopanic may still be recovered, the others terminate the program.
+	// Since Go 1.21, fatal is the fatal error of a user error like "concurrent map writes", and throw that of a runtime bug.
+	Kind string `json:"kind"`
+	Step uint64 `json:"step"`
+	PC   uint64 `json:"pc"`
+	// Message is the decoded panic message. The message of a fatalpanic is the message of the last gopanic.
+	Message string `json:"message"`
+	// Backtrace are the function names of the calling frames, innermost first.
+	Backtrace []string `json:"backtrace"`
+}
+
+// Fatal returns true if the panic terminates the program.
+func (p *GuestPanic) Fatal() bool {
+	return p.Kind != "gopanic"
+}
+
+// panicDetector detects the entry of the Go runtime functions that handle panics and fatal errors,
+// by the addresses of their symbols in the program metadata.
+type panicDetector struct {
+	meta *Metadata
+	// entry addresses of runtime.throw, runtime.fatal, runtime.gopanic and runtime.fatalpanic, 0 if the symbol is missing
+	throw, fatal, gopanic, fatalpanic uint64
+	// lastPanic is the message of the last gopanic
+	lastPanic string
+}
+
+// newPanicDetector returns a detector for the panics of the program, or nil if the metadata has none of the runtime symbols.
+func newPanicDetector(meta *Metadata) *panicDetector {
+	d := &panicDetector{meta: meta}
+	for _, s := range meta.Symbols {
+		switch s.Name {
+		case "runtime.throw":
+			d.throw = s.Start
+		case "runtime.fatal":
+			d.fatal = s.Start
+		case "runtime.gopanic":
+			d.gopanic = s.Start
+		case "runtime.fatalpanic":
+			d.fatalpanic = s.Start
+		}
+	}
+	if d.throw == 0 && d.fatal == 0 && d.gopanic == 0 && d.fatalpanic == 0 {
+		return nil
+	}
+	return d
+}
+
+// check returns the panic of the state, if the next step enters one of the runtime functions that handle panics.
+func (d *panicDetector) check(state *fast.VMState) *GuestPanic {
+	pc := state.PC
+	if pc == 0 || (pc != d.throw && pc != d.fatal && pc != d.gopanic && pc != d.fatalpanic) {
+		return nil
+	}
+	p := &GuestPanic{Step: state.Step, PC: pc, Backtrace: d.backtrace(state)}
+	regs := &state.Registers
+	switch pc {
+	case d.throw: // throw(s string)
+		p.Kind = "throw"
+		p.Message = readGuestString(state.Memory, regs[regA0], regs[regA1])
+	case d.fatal: // fatal(s string)
+		p.Kind = "fatal"
+		p.Message = readGuestString(state.Memory, regs[regA0], regs[regA1])
+	case d.gopanic: // gopanic(e any)
+		p.Kind = "gopanic"
+		p.Message = panicValueString(state.Memory, regs[regA0], regs[regA1])
+		d.lastPanic = p.Message
+	case d.fatalpanic: // fatalpanic(msgs *_panic)
+		p.Kind = "fatalpanic"
+		p.Message = d.lastPanic
+	}
+	return p
+}
+
+// backtrace returns the function names of the calling frames, on entry of a function.
+// Go does not use frame pointers on riscv64, so beyond the direct caller in the RA register,
+// the goroutine stack is scanned for words that are return addresses: addresses in a function,
+// right after a call instruction. This may include stale return addresses of frames that already returned.
+func (d *panicDetector) backtrace(state *fast.VMState) []string {
+	regs := &state.Registers
+	frames := []string{d.meta.LookupSymbol(state.PC)}
+	if isReturnAddress(state.Memory, d.meta, regs[regRA]) {
+		frames = append(frames, d.meta.LookupSymbol(regs[regRA]))
+	}
+	sp := regs[regSP]
+	end := sp + maxStackScan
+	if hi := readGuestU64(state.Memory, regs[regG]+8); hi > sp && hi < end {
+		end = hi
+	}
+	for addr := sp; addr+8 <= end && len(frames) < maxBacktraceFrames; addr += 8 {
+		if v := readGuestU64(state.Memory, addr); isReturnAddress(state.Memory, d.meta, v) {
+			frames = append(frames, d.meta.LookupSymbol(v))
+		}
+	}
+	return frames
+}
+
+// isReturnAddress returns true if v is an address in a function, right after a call instruction: JAL or JALR that links RA.
+func isReturnAddress(mem *fast.Memory, meta *Metadata, v uint64) bool {
+	if v < instrSize || v%instrSize != 0 || strings.HasPrefix(meta.LookupSymbol(v), "!") {
+		return false
+	}
+	var dat [4]byte
+	mem.GetUnaligned(v-instrSize, dat[:])
+	instr := binary.LittleEndian.Uint32(dat[:])
+	opcode, rd := instr&0x7f, (instr>>7)&0x1f
+	return (opcode == 0x6f || opcode == 0x67) && rd == regRA
+}
+
+func readGuestU64(mem *fast.Memory, addr uint64) uint64 {
+	var dat [8]byte
+	mem.GetUnaligned(addr, dat[:])
+	return binary.LittleEndian.Uint64(dat[:])
+}
+
+func readGuestBytes(mem *fast.Memory, addr uint64, length uint64) []byte {
+	if length > maxPanicMessage {
+		length = maxPanicMessage
+	}
+	dat, _ := io.ReadAll(mem.ReadMemoryRange(addr, length))
+	return dat
+}
+
+// readGuestString reads a string of the guest memory, as text if it is valid UTF-8, or as hex data otherwise.
+func readGuestString(mem *fast.Memory, addr uint64, length uint64) string {
+	dat := readGuestBytes(mem, addr, length)
+	if utf8.Valid(dat) {
+		return string(dat)
+	}
+	return fmt.Sprintf("%016x: %x", addr, dat)
+}
+
+// panicValueString decodes a panic value, from its runtime type and data pointer.
+// Strings are decoded, and pointers to a struct with a string as first field, like the errors of errors.New and fmt.Errorf.
+func panicValueString(mem *fast.Memory, typ uint64, data uint64) string {
+	if typ == 0 {
+		return "nil"
+	}
+	var kind [1]byte
+	mem.GetUnaligned(typ+typeKindOffset, kind[:])
+	switch kind[0] & typeKindMask {
+	case typeKindString: // the data points to the string header
+		return readGuestString(mem, readGuestU64(mem, data), readGuestU64(mem, data+8))
+	case typeKindPtr: // the data is the pointer itself, try the first field as a string header
+		if length := readGuestU64(mem, data+8); length > 0 && length <= maxPanicMessage {
+			if dat := readGuestBytes(mem, readGuestU64(mem, data), length); utf8.Valid(dat) {
+				return string(dat)
+			}
+		}
+	}
+	return fmt.Sprintf("panic value of type %#x (kind %d) at %#x", typ, kind[0]&typeKindMask, data)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+func TestPanicDetector(t *testing.T) {
+	meta := &Metadata{Symbols: []Symbol{
+		{Name: "runtime.throw", Start: 0x10000, Size: 0x40},
+		{Name: "runtime.fatal", Start: 0x10040, Size: 0x40},
+		{Name: "runtime.gopanic", Start: 0x10080, Size: 0x40},
+		{Name: "runtime.fatalpanic", Start: 0x100c0, Size: 0x40},
+		{Name: "main.caller", Start: 0x10100, Size: 0x40},
+		{Name: "main.main", Start: 0x10200, Size: 0x40},
+	}}
+	d := newPanicDetector(meta)
+	require.NotNil(t, d)
+
+	// the Go ABI details are literal, to catch changes of the constants: RA x1, SP x2, g x27 with stack.hi at g+8,
+	// the type kind at offset 23 of the type, and kinds 22 (pointer) and 24 (string).
+	// A goroutine at the entry of a runtime function, called by main.caller, with main.main on the stack
+	state := fast.NewVMState()
+	putU32 := func(addr uint64, v uint32) {
+		var dat [4]byte
+		binary.LittleEndian.PutUint32(dat[:], v)
+		state.Memory.SetUnaligned(addr, dat[:])
+	}
+	putU64 := func(addr uint64, v uint64) {
+		var dat [8]byte
+		binary.LittleEndian.PutUint64(dat[:], v)
+		state.Memory.SetUnaligned(addr, dat[:])
+	}
+	putU32(0x10110, 1<<7|0x6f)               // jal ra, 0: main.caller calls the runtime function
+	putU32(0x10220, 5<<15|1<<7|0x67)         // jalr ra, 0(t0): main.main calls main.caller
+	putU32(0x10230, 1<<20|10<<15|10<<7|0x13) // addi a0, a0, 1: not a call
+	state.Registers[1] = 0x10114             // ra
+	state.Registers[2] = 0x20000             // sp
+	state.Registers[27] = 0x30000            // g
+	putU64(0x30008, 0x20030)                 // stack.hi of g
+	putU64(0x20000, 0x10234)                 // after an instruction that is not a call
+	putU64(0x20008, 0x1234)                  // not in a function
+	putU64(0x20010, 0x10224)                 // return address into main.main
+	putU64(0x20038, 0x10114)                 // beyond the stack
+	backtrace := []string{"main.caller", "main.main"}
+
+	// strings, and the panic values that refer to them
+	state.Memory.SetUnaligned(0x40000, []byte("index out of range"))
+	state.Memory.SetUnaligned(0x40100, []byte("concurrent map writes"))
+	state.Memory.SetUnaligned(0x40200, []byte("boom"))
+	state.Memory.SetUnaligned(0x40300, []byte("some error"))
+	state.Memory.SetUnaligned(0x50000+23, []byte{24})
+	putU64(0x51000, 0x40200) // string header
+	putU64(0x51008, 4)
+	state.Memory.SetUnaligned(0x52000+23, []byte{22 | 0x20}) // with the direct interface flag
+	putU64(0x53000, 0x40300)                                 // *errors.errorString, with the string as first field
+	putU64(0x53008, 10)
+
+	check := func(pc uint64, a0, a1 uint64) *GuestPanic {
+		state.PC = pc
+		state.Registers[10] = a0
+		state.Registers[11] = a1
+		return d.check(state)
+	}
+
+	state.Step = 7
+	p := check(0x10000, 0x40000, 18)
+	require.Equal(t, &GuestPanic{
+		Kind:      "throw",
+		Step:      7,
+		PC:        0x10000,
+		Message:   "index out of range",
+		Backtrace: append([]string{"runtime.throw"}, backtrace...),
+	}, p)
+	require.True(t, p.Fatal())
+
+	p = check(0x10040, 0x40100, 21)
+	require.Equal(t, "fatal", p.Kind)
+	require.Equal(t, "concurrent map writes", p.Message)
+	require.Equal(t, append([]string{"runtime.fatal"}, backtrace...), p.Backtrace)
+	require.True(t, p.Fatal())
+
+	p = check(0x10080, 0x50000, 0x51000)
+	require.Equal(t, "gopanic", p.Kind)
+	require.Equal(t, "boom", p.Message)
+	require.False(t, p.Fatal(), "may be recovered")
+
+	p = check(0x10080, 0x52000, 0x53000)
+	require.Equal(t, "gopanic", p.Kind)
+	require.Equal(t, "some error", p.Message)
+
+	p = check(0x100c0, 0, 0)
+	require.Equal(t, "fatalpanic", p.Kind)
+	require.Equal(t, "some error", p.Message, "message of the last gopanic")
+	require.True(t, p.Fatal())
+
+	require.Nil(t, check(0x10004, 0, 0), "not the entry of a runtime function")
+	require.Nil(t, check(0x10100, 0, 0))
+
+	t.Run("stack bounds", func(t *testing.T) {
+		// without a valid stack.hi, the stack is scanned up to maxStackScan, including the stale return address
+		putU64(0x30008, 0)
+		defer putU64(0x30008, 0x20030)
+		p := check(0x10000, 0x40000, 18)
+		require.Equal(t, append([]string{"runtime.throw"}, append(backtrace, "main.caller")...), p.Backtrace)
+	})
+
+	t.Run("no symbols", func(t *testing.T) {
+		require.Nil(t, newPanicDetector(&Metadata{Symbols: []Symbol{{Name: "main.main", Start: 0x1000, Size: 4}}}))
+	})
+}
+
+func TestPanicValueString(t *testing.T) {
+	mem := fast.NewMemory()
+	require.Equal(t, "nil", panicValueString(mem, 0, 0))
+	mem.SetUnaligned(0x1000+23, []byte{2}) // int
+	require.Equal(t, "panic value of type 0x1000 (kind 2) at 0x2000", panicValueString(mem, 0x1000, 0x2000))
+
+	mem.SetUnaligned(0x3000, []byte{0xff, 0xfe})
+	require.Equal(t, "0000000000003000: fffe", readGuestString(mem, 0x3000, 2), "invalid UTF-8 as hex")
+}
@@ -28,6 +28,8 @@ type ProcessPreimageOracle struct {
 	cmd      *exec.Cmd
 	waitErr  chan error
 	cancelIO context.CancelCauseFunc
+	// exited is closed when the pre-image server process has exited
+	exited chan struct{}
 }
 
 const clientPollTimeout = time.Second * 15
@@ -49,6 +51,7 @@ func NewProcessPreimageOracle(name string, args []string) (*ProcessPreimageOracl
 	cmd := exec.Command(name, args...) // nosemgrep
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	detachSignals(cmd)
 	cmd.ExtraFiles = []*os.File{
 		hOracleRW.Reader(),
 		hOracleRW.Writer(),
@@ -67,6 +70,7 @@ func NewProcessPreimageOracle(name string, args []string) (*ProcessPreimageOracl
 		cmd:      cmd,
 		waitErr:  make(chan error),
 		cancelIO: cancelIO,
+		exited:   make(chan struct{}),
 	}
 	return out, nil
 }
@@ -104,8 +108,22 @@ func (p *ProcessPreimageOracle) Close() error {
 	return <-p.waitErr
 }
 
+// ExitErr returns an error if the pre-image server process has exited, or nil if it is still running, or if there is none.
+func (p *ProcessPreimageOracle) ExitErr() error {
+	if p.cmd == nil {
+		return nil
+	}
+	select {
+	case <-p.exited:
+		return fmt.Errorf("pre-image server exited with code %d", p.cmd.ProcessState.ExitCode())
+	default:
+		return nil
+	}
+}
+
 func (p *ProcessPreimageOracle) wait() {
 	err := p.cmd.Wait()
+	close(p.exited)
 	var waitErr error
 	if err, ok := err.(*exec.ExitError); !ok || !err.Success() {
 		waitErr = err
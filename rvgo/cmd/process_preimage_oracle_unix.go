@@ -0,0 +1,14 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachSignals starts the pre-image server in its own process group, so an interrupt from the terminal
+// does not reach it directly: it keeps serving the current step, and is shut down by Close.
+func detachSignals(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/urfave/cli/v2"
+
+	cannon "github.com/ethereum-optimism/optimism/cannon/cmd"
+	"github.com/ethereum-optimism/optimism/op-service/jsonutil"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+	"github.com/ethereum-optimism/asterisc/rvgo/snapshot"
+)
+
+var (
+	ProveStepsFlag = &cli.Uint64SliceFlag{
+		Name:     "steps",
+		Usage:    "steps to generate a proof at, comma-separated or repeated",
+		Required: true,
+	}
+	ProveSnapshotDirFlag = &cli.PathFlag{
+		Name:      "snapshot-dir",
+		Usage:     "directory of snapshots to run from, as written by run --snapshot-dir. File names are parsed with the base name of --snapshot-fmt.",
+		TakesFile: true,
+		Required:  true,
+	}
+	ProveInputFlag = &cli.PathFlag{
+		Name:      "input",
+		Usage:     "path of the state to run from, for steps before the first snapshot in --snapshot-dir",
+		TakesFile: true,
+	}
+	ProveWorkersFlag = &cli.IntFlag{
+		Name:  "workers",
+		Usage: "number of proofs to generate concurrently, each with its own pre-image server",
+		Value: runtime.NumCPU(),
+	}
+)
+
+// proveRunChunk is the number of steps to run forward between checks of the pre-image server process,
+// so a server that exited is noticed before the proof step.
+const proveRunChunk = 1 << 20
+
+// proveJob is a group of target steps, that are generated by running forward from the same starting state.
+type proveJob struct {
+	// path of the state to start from
+	start string
+	// sorted steps to generate proofs at
+	steps []uint64
+}
+
+func Prove(ctx *cli.Context) error {
+	l := Logger(os.Stderr, log.LevelInfo)
+
+	snapshotFmt := ctx.String(cannon.RunSnapshotFmtFlag.Name)
+	store, err := snapshot.OpenStore(ctx.Path(ProveSnapshotDirFlag.Name), filepath.Base(snapshotFmt), snapshot.Retention{})
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot dir: %w", err)
+	}
+	inputPath := ctx.Path(ProveInputFlag.Name)
+
+	steps := append([]uint64(nil), ctx.Uint64Slice(ProveStepsFlag.Name)...)
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i] < steps[j]
+	})
+	// group the steps by the nearest preceding snapshot, so each snapshot is only loaded and run from once
+	var jobs []*proveJob
+	proofs := 0
+	for i, step := range steps {
+		if i > 0 && steps[i-1] == step {
+			continue
+		}
+		proofs++
+		start := inputPath
+		if nearest, ok := store.Nearest(step); ok {
+			start = store.Path(nearest)
+		} else if inputPath == "" {
+			return fmt.Errorf("no snapshot at or before step %d, and no --input state to run from", step)
+		}
+		if len(jobs) == 0 || jobs[len(jobs)-1].start != start {
+			jobs = append(jobs, &proveJob{start: start})
+		}
+		job := jobs[len(jobs)-1]
+		job.steps = append(job.steps, step)
+	}
+
+	workers := ctx.Int(ProveWorkersFlag.Name)
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	l.Info("generating proofs", "proofs", proofs, "jobs", len(jobs), "workers", workers)
+
+	args := preimageServerArgs(ctx)
+	proofFmt := ctx.String(cannon.RunProofFmtFlag.Name)
+	decodeCache := ctx.Bool(RunDecodeCacheFlag.Name)
+
+	jobCh := make(chan *proveJob)
+	errCh := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				if err := proveJobSteps(ctx, l, job, args, proofFmt, decodeCache); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	var errs []error
+loop:
+	for _, job := range jobs {
+		select {
+		case jobCh <- job:
+		case err := <-errCh:
+			errs = append(errs, err)
+			break loop
+		case <-ctx.Context.Done():
+			errs = append(errs, ctx.Context.Err())
+			break loop
+		}
+	}
+	close(jobCh)
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// proveJobSteps runs forward from the starting state of the job, with its own pre-image server,
+// and writes the proofs at the steps of the job.
+func proveJobSteps(ctx *cli.Context, l log.Logger, job *proveJob, args []string, proofFmt string, decodeCache bool) error {
+	state, err := LoadState(job.start)
+	if err != nil {
+		return fmt.Errorf("failed to load state %q: %w", job.start, err)
+	}
+	po, err := NewProcessPreimageOracle(args[0], args[1:])
+	if err != nil {
+		return fmt.Errorf("failed to create pre-image oracle process: %w", err)
+	}
+	if err := po.Start(); err != nil {
+		return fmt.Errorf("failed to start pre-image oracle server: %w", err)
+	}
+	defer func() {
+		if err := po.Close(); err != nil {
+			l.Error("failed to close pre-image server", "err", err)
+		}
+	}()
+
+	outLog := &LoggingWriter{Name: "program std-out", Log: l}
+	errLog := &LoggingWriter{Name: "program std-err", Log: l}
+	us := fast.NewInstrumentedState(state, po, outLog, errLog)
+	us.SetDecodeCache(decodeCache)
+	stepFn := func(proof bool) (*fast.StepWitness, error) {
+		wit, err := us.Step(proof)
+		if err != nil {
+			if exitErr := po.ExitErr(); exitErr != nil {
+				return nil, fmt.Errorf("%w, resulting in err %w", exitErr, err)
+			}
+			return nil, err
+		}
+		return wit, nil
+	}
+
+	for _, target := range job.steps {
+		if target < state.Step {
+			return fmt.Errorf("cannot prove step %d, starting state %q is at step %d", target, job.start, state.Step)
+		}
+		for state.Step < target && !state.Exited {
+			chunkEnd := target
+			if state.Step+proveRunChunk < chunkEnd {
+				chunkEnd = state.Step + proveRunChunk
+			}
+			var err error
+			if decodeCache {
+				err = us.RunUntil(ctx.Context, func(state *fast.VMState) bool {
+					return state.Step >= chunkEnd
+				})
+			} else { // RunUntil requires the decode cache
+				for state.Step < chunkEnd && !state.Exited && err == nil {
+					_, err = us.Step(false)
+				}
+			}
+			if exitErr := po.ExitErr(); exitErr != nil {
+				return fmt.Errorf("failed to run to step %d (at step %d): %w", target, state.Step, errors.Join(exitErr, err))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to run to step %d (PC: %08x): %w", target, state.PC, err)
+			}
+		}
+		if state.Exited {
+			return fmt.Errorf("cannot prove step %d, the program exited at step %d", target, state.Step)
+		}
+		// each worker merkleizes its own state, so the workers do not compete for CPUs
+		proof, err := fast.ProveStep(state, stepFn, 1)
+		if err != nil {
+			return err
+		}
+		if err := jsonutil.WriteJSON(fmt.Sprintf(proofFmt, target), proof, OutFilePerm); err != nil {
+			return fmt.Errorf("failed to write proof data: %w", err)
+		}
+		l.Info("generated proof", "step", target, "start", job.start)
+	}
+	return nil
+}
+
+var ProveCommand = &cli.Command{
+	Name:        "prove",
+	Usage:       "Generate proofs at steps concurrently, from a directory of snapshots",
+	Description: "Generate proofs at the given steps concurrently. Each worker loads the nearest preceding snapshot, runs forward with its own pre-image server, and writes the proofs of its steps. The pre-image server command follows '--'.",
+	Action:      Prove,
+	Flags: []cli.Flag{
+		ProveStepsFlag,
+		ProveSnapshotDirFlag,
+		cannon.RunSnapshotFmtFlag,
+		ProveInputFlag,
+		cannon.RunProofFmtFlag,
+		ProveWorkersFlag,
+		RunDecodeCacheFlag,
+	},
+}
@@ -1,8 +1,14 @@
 package cmd
 
 import (
+	"debug/elf"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -13,27 +19,140 @@ import (
 	"github.com/pkg/profile"
 
 	cannon "github.com/ethereum-optimism/optimism/cannon/cmd"
-	preimage "github.com/ethereum-optimism/optimism/op-preimage"
 	"github.com/ethereum-optimism/optimism/op-service/jsonutil"
+	opmetrics "github.com/ethereum-optimism/optimism/op-service/metrics"
 
 	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+	"github.com/ethereum-optimism/asterisc/rvgo/snapshot"
 )
 
-type Proof struct {
-	Step uint64 `json:"step"`
+// Proof is the proof data of a step, as written to the --proof-fmt files.
+type Proof = fast.Proof
 
-	Pre  common.Hash `json:"pre"`
-	Post common.Hash `json:"post"`
-
-	StateData hexutil.Bytes `json:"state-data"`
-	ProofData hexutil.Bytes `json:"proof-data"`
+// StateHashRecord is a state hash commitment at a step, as appended to the --hash-out file, one JSON record per line.
+type StateHashRecord struct {
+	Step uint64      `json:"step"`
+	Hash common.Hash `json:"hash"`
+}
 
-	OracleKey    hexutil.Bytes `json:"oracle-key,omitempty"`
-	OracleValue  hexutil.Bytes `json:"oracle-value,omitempty"`
-	OracleOffset uint64        `json:"oracle-offset,omitempty"`
+var RunDecodeCacheFlag = &cli.BoolFlag{
+	Name:  "decode-cache",
+	Usage: "cache predecoded instructions, to speed up execution of steps without proof generation",
 }
 
-type StepFn func(proof bool) (*fast.StepWitness, error)
+var (
+	RunSnapshotDeltaFlag = &cli.BoolFlag{
+		Name:  "snapshot-delta",
+		Usage: "write snapshots as deltas, containing only the memory pages changed since the last full snapshot. The first snapshot is always full.",
+	}
+	RunMerkleCacheFlag = &cli.BoolFlag{
+		Name:  "merkle-cache",
+		Usage: "include the memory merkle cache in full snapshots and the output state, so their state hash is available right after loading them, without rehashing all memory",
+	}
+	RunSnapshotFullAtFlag = &cli.GenericFlag{
+		Name:  "snapshot-full-at",
+		Usage: "step pattern to write a full snapshot at, instead of a delta, when a snapshot is written with --snapshot-delta: " + "'never' (default), 'always', '=123' at exactly step 123, '%123' for every 123 steps",
+		Value: new(cannon.StepMatcherFlag),
+	}
+	RunHashAtFlag = &cli.GenericFlag{
+		Name:  "hash-at",
+		Usage: "step pattern to record the state hash at, without writing a snapshot: " + "'never' (default), 'always', '=123' at exactly step 123, '%123' for every 123 steps",
+		Value: new(cannon.StepMatcherFlag),
+	}
+	RunHashOutFlag = &cli.PathFlag{
+		Name:      "hash-out",
+		Usage:     "path of the file to append the state hash records of --hash-at to, one JSON record per line. Use - to write to Stdout.",
+		TakesFile: true,
+		Value:     "hashes.jsonl",
+	}
+	RunSnapshotDirFlag = &cli.PathFlag{
+		Name:      "snapshot-dir",
+		Usage:     "directory to write the snapshots of --snapshot-at into, indexed by step. File names are formatted with the base name of --snapshot-fmt.",
+		TakesFile: true,
+	}
+	RunSnapshotKeepEveryFlag = &cli.Uint64Flag{
+		Name:  "snapshot-keep-every",
+		Usage: "keep the snapshots in --snapshot-dir at steps that are a multiple of this number. If this or --snapshot-keep-last is set, other snapshots are removed.",
+	}
+	RunSnapshotKeepLastFlag = &cli.IntFlag{
+		Name:  "snapshot-keep-last",
+		Usage: "keep the latest snapshots in --snapshot-dir, up to this number. If this or --snapshot-keep-every is set, other snapshots are removed.",
+	}
+	RunResumeFromDirFlag = &cli.PathFlag{
+		Name:      "resume-from-dir",
+		Usage:     "directory of snapshots to resume from, as written with --snapshot-dir. The latest snapshot at or before --resume-at is used instead of --input, if there is one.",
+		TakesFile: true,
+	}
+	RunResumeAtFlag = &cli.Uint64Flag{
+		Name:  "resume-at",
+		Usage: "step to resume at, with --resume-from-dir. Defaults to the latest snapshot.",
+	}
+	RunInterruptSnapshotFlag = &cli.PathFlag{
+		Name:      "interrupt-snapshot",
+		Usage:     "path to write the state to when the run is interrupted by SIGINT or SIGTERM, instead of --output. Binary if the path ends with .bin or .bin.gz, JSON otherwise.",
+		TakesFile: true,
+	}
+	RunMaxStepsFlag = &cli.Uint64Flag{
+		Name:  "max-steps",
+		Usage: "maximum number of steps to run, after which the run stops and the state is written to --output. 0 for no limit.",
+	}
+	RunMaxDurationFlag = &cli.DurationFlag{
+		Name:  "max-duration",
+		Usage: "maximum wall-clock duration of the run, after which the run stops and the state is written to --output. 0 for no limit.",
+	}
+	RunMetricsAddrFlag = &cli.StringFlag{
+		Name:  "metrics.addr",
+		Usage: "host:port address to serve Prometheus metrics of the run on, e.g. 127.0.0.1:7300. Disabled if empty.",
+	}
+	RunCoverageFlag = &cli.PathFlag{
+		Name:      "coverage",
+		Usage:     "path to write a JSON report of the guest code coverage to, per function and per line. Convert it to a Go coverage profile with the coverage command.",
+		TakesFile: true,
+	}
+	RunCoverageELFFlag = &cli.PathFlag{
+		Name:      "coverage-elf",
+		Usage:     "path of the ELF program that is run, to read the functions and DWARF line info of the --coverage report from. Without it, only functions of the --meta symbols are reported.",
+		TakesFile: true,
+	}
+	RunCountersFlag = &cli.PathFlag{
+		Name:      "counters",
+		Usage:     "path to write the counts of executed instruction encodings, syscalls and memory proof patterns to, as JSON. Counting disables the decode cache. Report them with the counters command.",
+		TakesFile: true,
+	}
+	RunWatchFlag = &cli.StringSliceFlag{
+		Name:  "watch",
+		Usage: "memory range to log the guest loads and stores of, as addr[:len][:rw], e.g. 0x8000:8:w. The length defaults to 1 byte, the mode to rw. Repeat the flag to watch multiple ranges.",
+	}
+	RunWatchStopFlag = &cli.BoolFlag{
+		Name:  "watch-stop",
+		Usage: "stop the run after the first step that touches a --watch range",
+	}
+	RunStraceFlag = &cli.PathFlag{
+		Name:      "strace",
+		Usage:     "path of the file to log every syscall handled by the VM to, one line per syscall, with the step, PC, symbol, arguments a0-a5, return value and error code",
+		TakesFile: true,
+	}
+	RunStrictSyscallsFlag = &cli.StringFlag{
+		Name:  "strict-syscalls",
+		Usage: "policy for syscalls that the VM only emulates, e.g. madvise, pipe2, getrandom, and mmap without MAP_ANONYMOUS: 'off', 'warn' to log them, or 'error' to stop the run with an error. Off-chain only, proofs are not affected.",
+		Value: "off",
+	}
+	RunStrictSyscallsPolicyFlag = &cli.StringSliceFlag{
+		Name:  "strict-syscalls.policy",
+		Usage: "override of the --strict-syscalls policy for a syscall, as name=policy, e.g. madvise=off. Repeat the flag to override multiple syscalls. The emulated syscalls that the Go runtime makes on startup, e.g. clock_gettime and rt_sigaction, and mmap at an address hint, are only checked with an override.",
+	}
+	RunStopAtPanicFlag = &cli.BoolFlag{
+		Name:  "stop-at-panic",
+		Usage: "stop the run when the guest enters runtime.throw, runtime.fatal or runtime.fatalpanic, before the step that enters it. Panics are detected with the --meta symbols, and are always logged.",
+	}
+	RunSummaryFlag = &cli.PathFlag{
+		Name:      "summary",
+		Usage:     "path to write a JSON summary of the run to at the end: steps, speed, final status and hash, and pre-image usage. Use - to write to Stdout.",
+		TakesFile: true,
+	}
+)
+
+type StepFn = fast.StepFn
 
 func Guard(proc *os.ProcessState, fn StepFn) StepFn {
 	return func(proof bool) (*fast.StepWitness, error) {
@@ -53,52 +172,313 @@ var _ fast.PreimageOracle = (*ProcessPreimageOracle)(nil)
 
 var OutFilePerm = os.FileMode(0o755)
 
+// metricsInterval is the number of steps between updates of the run progress metrics.
+const metricsInterval = 100_000
+
+// preimageServerArgs returns the command and args of the pre-image server, from the CLI args after the first '--'.
+// The command is empty if there are no such args.
+func preimageServerArgs(ctx *cli.Context) []string {
+	args := ctx.Args().Slice()
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	return args
+}
+
+// stepMatcher returns the matcher of a step matcher flag, or nil if it never matches, so the run can skip it.
+func stepMatcher(ctx *cli.Context, name string) fast.StepMatcher {
+	f := ctx.Generic(name).(*cannon.StepMatcherFlag)
+	if repr := f.String(); repr == "" || repr == "never" {
+		return nil
+	}
+	m := f.Matcher()
+	return func(state *fast.VMState) bool {
+		return m(state)
+	}
+}
+
+// runHooks are the callbacks of the run command to the runner: the logging, metrics and outputs of the steps.
+type runHooks struct {
+	l    log.Logger
+	meta *Metadata
+	m    *RunMetrics
+	us   *fast.InstrumentedState
+
+	start     time.Time
+	startStep uint64
+	// wallTime is the duration of the run, set when it stops
+	wallTime time.Duration
+	infoAt   fast.StepMatcher
+
+	// coverageHits is the execution count per PC, nil if coverage is not recorded
+	coverageHits map[uint64]uint64
+
+	stopAt      fast.StepMatcher
+	panics      *panicDetector
+	stopAtPanic bool
+	// guestPanic is the last panic of the program, if any
+	guestPanic *GuestPanic
+
+	watchStop bool
+
+	snapshots *fast.SnapshotWriter
+
+	proofAt    fast.StepMatcher
+	proofFmt   string
+	proofStart time.Time
+
+	hashEnc *json.Encoder
+
+	// reports of the run, written by writeReports, nil if not written
+	counters *fast.Counters
+	// counter counts the pre-image fetches and hints for the summary
+	counter *countingOracle
+	// errTail is the tail of the program std-err for the summary
+	errTail *tailWriter
+}
+
+// stopAtOrPanic detects panics before the stop condition, so the panic of the step to stop at is logged.
+func (h *runHooks) stopAtOrPanic(state *fast.VMState) bool {
+	if h.panics != nil {
+		if p := h.panics.check(state); p != nil {
+			logFn := h.l.Warn
+			if p.Fatal() {
+				logFn = h.l.Error
+			}
+			logFn("guest "+p.Kind, "step", p.Step, "pc", HexU32(p.PC), "message", p.Message)
+			for i, name := range p.Backtrace {
+				logFn("backtrace", "frame", i, "name", name)
+			}
+			h.guestPanic = p
+			if h.stopAtPanic && p.Fatal() {
+				return true
+			}
+		}
+	}
+	return h.stopAt != nil && h.stopAt(state)
+}
+
+// stopAfterWatchHit logs the watchpoint hits of the step, and stops after the step if it hit any with --watch-stop.
+func (h *runHooks) stopAfterWatchHit(state *fast.VMState) bool {
+	hits := h.us.WatchHits()
+	for _, hit := range hits {
+		h.l.Info("watchpoint hit",
+			"step", hit.Step,
+			"pc", HexU32(hit.PC),
+			"name", h.meta.LookupSymbol(hit.PC),
+			"addr", HexU64(hit.Addr),
+			"write", hit.Write,
+			"data", hexutil.Bytes(hit.Data),
+		)
+	}
+	return h.watchStop && len(hits) > 0
+}
+
+func (h *runHooks) onStep(state *fast.VMState) error {
+	step := state.Step
+	if step%metricsInterval == 0 {
+		h.m.RecordProgress(state)
+	}
+	if h.infoAt != nil && h.infoAt(state) {
+		delta := time.Since(h.start)
+		h.l.Info("processing",
+			"step", step,
+			"pc", HexU32(state.PC),
+			"insn", HexU32(state.Instr()),
+			"ips", float64(step-h.startStep)/(float64(delta)/float64(time.Second)),
+			"pages", state.Memory.PageCount(),
+			"mem", state.Memory.Usage(),
+			"name", h.meta.LookupSymbol(state.PC),
+		)
+	}
+	if h.coverageHits != nil {
+		h.coverageHits[state.PC]++
+	}
+	return nil
+}
+
+func (h *runHooks) onSnapshot(state *fast.VMState) error {
+	snapshotStart := time.Now()
+	if err := h.snapshots.Snapshot(state); err != nil {
+		return err
+	}
+	h.m.RecordSnapshot(time.Since(snapshotStart))
+	return nil
+}
+
+// proofAtTimed matches the steps of --proof-at, and starts the proof timer of the metrics.
+func (h *runHooks) proofAtTimed(state *fast.VMState) bool {
+	if h.proofAt(state) {
+		h.proofStart = time.Now()
+		return true
+	}
+	return false
+}
+
+func (h *runHooks) onProof(proof *fast.Proof) error {
+	if err := jsonutil.WriteJSON(fmt.Sprintf(h.proofFmt, proof.Step), proof, OutFilePerm); err != nil {
+		return fmt.Errorf("failed to write proof data: %w", err)
+	}
+	h.m.RecordProof(time.Since(h.proofStart))
+	return nil
+}
+
+func (h *runHooks) onHash(step uint64, hash common.Hash) error {
+	if err := h.hashEnc.Encode(&StateHashRecord{Step: step, Hash: hash}); err != nil {
+		return fmt.Errorf("failed to write state hash: %w", err)
+	}
+	return nil
+}
+
+// writeReports writes the counters, coverage and summary of the run, that are enabled by the flags.
+// They are written after every run, also if it failed with runErr, so they cover the steps up to the failure.
+func (h *runHooks) writeReports(ctx *cli.Context, state *fast.VMState, runErr error) error {
+	if countersPath := ctx.Path(RunCountersFlag.Name); countersPath != "" {
+		if err := jsonutil.WriteJSON(countersPath, h.counters, OutFilePerm); err != nil {
+			return fmt.Errorf("failed to write counters: %w", err)
+		}
+	}
+
+	if coveragePath := ctx.Path(RunCoverageFlag.Name); coveragePath != "" {
+		var elfProgram *elf.File
+		if elfPath := ctx.Path(RunCoverageELFFlag.Name); elfPath != "" {
+			var err error
+			elfProgram, err = elf.Open(elfPath)
+			if err != nil {
+				return fmt.Errorf("failed to open ELF file %q: %w", elfPath, err)
+			}
+			defer elfProgram.Close()
+		}
+		coverage, err := MakeCoverage(h.coverageHits, h.meta, elfProgram)
+		if err != nil {
+			return fmt.Errorf("failed to compute coverage: %w", err)
+		}
+		if err := jsonutil.WriteJSON(coveragePath, coverage, OutFilePerm); err != nil {
+			return fmt.Errorf("failed to write coverage report: %w", err)
+		}
+	}
+
+	if summaryPath := ctx.Path(RunSummaryFlag.Name); summaryPath != "" {
+		finalHash, err := state.EncodeWitnessParallel(runtime.NumCPU()).StateHash()
+		if err != nil {
+			return fmt.Errorf("failed to hash final state: %w", err)
+		}
+		steps := state.Step - h.startStep
+		ips := 0.0 // without wall time the rate is undefined, and JSON cannot encode NaN or infinity
+		if h.wallTime > 0 {
+			ips = float64(steps) / h.wallTime.Seconds()
+		}
+		summary := &RunSummary{
+			Steps:      steps,
+			WallTime:   h.wallTime.Seconds(),
+			IPS:        ips,
+			Status:     state.VMStatus(),
+			Exited:     state.Exited,
+			ExitCode:   state.ExitCode,
+			FinalStep:  state.Step,
+			FinalHash:  finalHash,
+			PeakPages:  state.Memory.PageCount(), // pages are never freed
+			Preimages:  h.counter.preimages,
+			Hints:      h.counter.hints,
+			StdErrTail: h.errTail.String(),
+			Panic:      h.guestPanic,
+		}
+		if runErr != nil {
+			summary.Error = runErr.Error()
+		}
+		if err := jsonutil.WriteJSON(summaryPath, summary, OutFilePerm); err != nil {
+			return fmt.Errorf("failed to write run summary: %w", err)
+		}
+	}
+	return nil
+}
+
+// snapshotWriter returns the writer of the snapshots of the run, to the snapshot store if not nil.
+func snapshotWriter(ctx *cli.Context, store *snapshot.Store) *fast.SnapshotWriter {
+	snapshotFmt := ctx.String(cannon.RunSnapshotFmtFlag.Name)
+	merkleCache := ctx.Bool(RunMerkleCacheFlag.Name)
+	w := &fast.SnapshotWriter{
+		Path: func(step uint64) string {
+			return fmt.Sprintf(snapshotFmt, step)
+		},
+		WriteFull: func(path string, state *fast.VMState) error {
+			if err := WriteState(path, state, merkleCache); err != nil {
+				return fmt.Errorf("failed to write state snapshot: %w", err)
+			}
+			return nil
+		},
+		FullAt: stepMatcher(ctx, RunSnapshotFullAtFlag.Name),
+	}
+	if ctx.Bool(RunSnapshotDeltaFlag.Name) {
+		w.WriteDelta = func(path string, state *fast.VMState, basePath string) error {
+			if err := WriteStateDelta(path, state, basePath); err != nil {
+				return fmt.Errorf("failed to write state delta snapshot: %w", err)
+			}
+			return nil
+		}
+	}
+	if store != nil {
+		w.Path = store.Path
+		w.OnWritten = func(step uint64) error {
+			if err := store.Add(step); err != nil {
+				return fmt.Errorf("failed to update snapshot dir: %w", err)
+			}
+			return nil
+		}
+	}
+	return w
+}
+
 func Run(ctx *cli.Context) error {
 	if ctx.Bool(cannon.RunPProfCPU.Name) {
 		defer profile.Start(profile.NoShutdownHook, profile.ProfilePath("."), profile.CPUProfile).Stop()
 	}
 
-	state, err := jsonutil.LoadJSON[fast.VMState](ctx.Path(cannon.RunInputFlag.Name))
+	l := Logger(os.Stderr, log.LevelInfo)
+
+	snapshotFmt := ctx.String(cannon.RunSnapshotFmtFlag.Name)
+	inputPath := ctx.Path(cannon.RunInputFlag.Name)
+	if resumeDir := ctx.Path(RunResumeFromDirFlag.Name); resumeDir != "" {
+		resumeStore, err := snapshot.OpenStore(resumeDir, filepath.Base(snapshotFmt), snapshot.Retention{})
+		if err != nil {
+			return fmt.Errorf("failed to open snapshot dir to resume from: %w", err)
+		}
+		resumeAt := ^uint64(0)
+		if ctx.IsSet(RunResumeAtFlag.Name) {
+			resumeAt = ctx.Uint64(RunResumeAtFlag.Name)
+		}
+		if step, ok := resumeStore.Nearest(resumeAt); ok {
+			inputPath = resumeStore.Path(step)
+			l.Info("resuming from snapshot", "step", step, "path", inputPath)
+		} else {
+			l.Info("no snapshot to resume from, starting from input", "input", inputPath)
+		}
+	}
+	state, err := LoadState(inputPath)
 	if err != nil {
 		return err
 	}
 
-	l := Logger(os.Stderr, log.LevelInfo)
 	outLog := &LoggingWriter{Name: "program std-out", Log: l}
 	errLog := &LoggingWriter{Name: "program std-err", Log: l}
-
-	stopAtAnyPreimage := false
-	var stopAtPreimageTypeByte preimage.KeyType
-	switch ctx.String(cannon.RunStopAtPreimageTypeFlag.Name) {
-	case "local":
-		stopAtPreimageTypeByte = preimage.LocalKeyType
-	case "keccak":
-		stopAtPreimageTypeByte = preimage.Keccak256KeyType
-	case "sha256":
-		stopAtPreimageTypeByte = preimage.Sha256KeyType
-	case "blob":
-		stopAtPreimageTypeByte = preimage.BlobKeyType
-	case "any":
-		stopAtAnyPreimage = true
-	case "":
-		// 0 preimage type is forbidden so will not stop at any preimage
-	default:
-		return fmt.Errorf("invalid preimage type %q", ctx.String(cannon.RunStopAtPreimageTypeFlag.Name))
-	}
-	stopAtPreimageLargerThan := ctx.Int(cannon.RunStopAtPreimageLargerThanFlag.Name)
-
-	// split CLI args after first '--'
-	args := ctx.Args().Slice()
-	for i, arg := range args {
-		if arg == "--" {
-			args = args[i+1:]
-			break
-		}
+	summaryPath := ctx.Path(RunSummaryFlag.Name)
+	var errTail *tailWriter
+	if summaryPath != "" {
+		errTail = newTailWriter(errLog, 4096)
 	}
-	if len(args) == 0 {
-		args = []string{""}
+
+	stopAtPreimage, err := fast.PreimageStopMatcher(ctx.String(cannon.RunStopAtPreimageTypeFlag.Name), ctx.Int(cannon.RunStopAtPreimageLargerThanFlag.Name))
+	if err != nil {
+		return err
 	}
 
+	args := preimageServerArgs(ctx)
 	po, err := NewProcessPreimageOracle(args[0], args[1:])
 	if err != nil {
 		return fmt.Errorf("failed to create pre-image oracle process: %w", err)
@@ -112,10 +492,16 @@ func Run(ctx *cli.Context) error {
 		}
 	}()
 
-	stopAt := ctx.Generic(cannon.RunStopAtFlag.Name).(*cannon.StepMatcherFlag).Matcher()
-	proofAt := ctx.Generic(cannon.RunProofAtFlag.Name).(*cannon.StepMatcherFlag).Matcher()
-	snapshotAt := ctx.Generic(cannon.RunSnapshotAtFlag.Name).(*cannon.StepMatcherFlag).Matcher()
-	infoAt := ctx.Generic(cannon.RunInfoAtFlag.Name).(*cannon.StepMatcherFlag).Matcher()
+	merkleCache := ctx.Bool(RunMerkleCacheFlag.Name)
+	hashOut := os.Stdout
+	if hashOutPath := ctx.Path(RunHashOutFlag.Name); hashOutPath != "-" && ctx.IsSet(RunHashAtFlag.Name) {
+		f, err := os.OpenFile(hashOutPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, OutFilePerm)
+		if err != nil {
+			return fmt.Errorf("failed to open state hash output file: %w", err)
+		}
+		defer f.Close()
+		hashOut = f
+	}
 
 	var meta *Metadata
 	if metaPath := ctx.Path(cannon.RunMetaFlag.Name); metaPath == "" {
@@ -129,104 +515,183 @@ func Run(ctx *cli.Context) error {
 		}
 	}
 
-	us := fast.NewInstrumentedState(state, po, outLog, errLog)
-	proofFmt := ctx.String(cannon.RunProofFmtFlag.Name)
-	snapshotFmt := ctx.String(cannon.RunSnapshotFmtFlag.Name)
-
-	stepFn := us.Step
-	if po.cmd != nil {
-		stepFn = Guard(po.cmd.ProcessState, stepFn)
+	var oracle fast.PreimageOracle = po
+	var counter *countingOracle
+	var stdErr io.Writer = errLog
+	if summaryPath != "" {
+		counter = newCountingOracle(oracle)
+		oracle = counter
+		stdErr = errTail
 	}
-
-	start := time.Now()
-	startStep := state.Step
-
-	for !state.Exited {
-		if state.Step%100 == 0 { // don't do the ctx err check (includes lock) too often
-			if err := ctx.Context.Err(); err != nil {
-				return err
+	var m *RunMetrics
+	if metricsAddr := ctx.String(RunMetricsAddrFlag.Name); metricsAddr != "" {
+		registry := opmetrics.NewRegistry()
+		m = NewRunMetrics(registry)
+		oracle = &metricsOracle{PreimageOracle: oracle, m: m}
+		srv, err := StartMetricsServer(registry, metricsAddr)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+		defer func() {
+			if err := srv.Close(); err != nil {
+				l.Error("failed to close metrics server", "err", err)
 			}
+		}()
+		l.Info("serving metrics", "addr", metricsAddr)
+	}
+	us := fast.NewInstrumentedState(state, oracle, outLog, stdErr)
+	us.SetDecodeCache(ctx.Bool(RunDecodeCacheFlag.Name))
+	var watchpoints []fast.Watchpoint
+	for _, v := range ctx.StringSlice(RunWatchFlag.Name) {
+		w, err := ParseWatchpoint(v)
+		if err != nil {
+			return err
 		}
-
-		step := state.Step
-
-		if infoAt(state) {
-			delta := time.Since(start)
-			l.Info("processing",
-				"step", step,
-				"pc", HexU32(state.PC),
-				"insn", HexU32(state.Instr()),
-				"ips", float64(step-startStep)/(float64(delta)/float64(time.Second)),
-				"pages", state.Memory.PageCount(),
-				"mem", state.Memory.Usage(),
-				"name", meta.LookupSymbol(state.PC),
+		watchpoints = append(watchpoints, w)
+	}
+	us.SetWatchpoints(watchpoints)
+	var counters *fast.Counters
+	if ctx.Path(RunCountersFlag.Name) != "" {
+		counters = fast.NewCounters()
+		us.SetCounters(counters)
+	}
+	var strace *straceWriter
+	if stracePath := ctx.Path(RunStraceFlag.Name); stracePath != "" {
+		f, err := os.OpenFile(stracePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, OutFilePerm)
+		if err != nil {
+			return fmt.Errorf("failed to open strace output file: %w", err)
+		}
+		defer f.Close()
+		strace = newStraceWriter(f, meta)
+		// flushed on every return, so the syscalls up to a failed step are logged too
+		defer func() {
+			if err := strace.Flush(); err != nil {
+				l.Error("failed to write strace output", "err", err)
+			}
+		}()
+		us.SetTracer(strace)
+	}
+	strict, err := ParseStrictSyscalls(ctx.String(RunStrictSyscallsFlag.Name), ctx.StringSlice(RunStrictSyscallsPolicyFlag.Name))
+	if err != nil {
+		return err
+	}
+	if strict != nil {
+		strict.Warn = func(v *fast.SyscallViolation) {
+			l.Warn("emulated syscall",
+				"step", v.Step,
+				"pc", HexU32(v.PC),
+				"name", meta.LookupSymbol(v.PC),
+				"syscall", fast.SyscallName(v.Num),
+				"reason", v.Reason,
 			)
 		}
+		us.SetStrictSyscalls(strict)
+	}
 
-		if stopAt(state) {
-			break
+	var snapshotStore *snapshot.Store
+	if snapshotDir := ctx.Path(RunSnapshotDirFlag.Name); snapshotDir != "" {
+		retention := snapshot.Retention{
+			KeepEvery: ctx.Uint64(RunSnapshotKeepEveryFlag.Name),
+			KeepLast:  ctx.Int(RunSnapshotKeepLastFlag.Name),
 		}
-
-		if snapshotAt(state) {
-			if err := jsonutil.WriteJSON(fmt.Sprintf(snapshotFmt, step), state, OutFilePerm); err != nil {
-				return fmt.Errorf("failed to write state snapshot: %w", err)
-			}
+		if ctx.Bool(RunSnapshotDeltaFlag.Name) && !retention.KeepsAll() {
+			return errors.New("delta snapshots cannot be removed independently of their base snapshot, pruning is not supported with --snapshot-delta")
 		}
-
-		prevPreimageOffset := state.PreimageOffset
-
-		if proofAt(state) {
-			preStateHash, err := state.EncodeWitness().StateHash()
-			if err != nil {
-				return fmt.Errorf("failed to hash prestate witness: %w", err)
-			}
-			witness, err := stepFn(true)
-			if err != nil {
-				return fmt.Errorf("failed at proof-gen step %d (PC: %08x): %w", step, state.PC, err)
-			}
-			postStateHash, err := state.EncodeWitness().StateHash()
-			if err != nil {
-				return fmt.Errorf("failed to hash poststate witness: %w", err)
-			}
-			proof := &Proof{
-				Step:      step,
-				Pre:       preStateHash,
-				Post:      postStateHash,
-				StateData: witness.State,
-				ProofData: witness.MemProof,
-			}
-			if witness.HasPreimage() {
-				proof.OracleKey = witness.PreimageKey[:]
-				proof.OracleValue = witness.PreimageValue
-				proof.OracleOffset = witness.PreimageOffset
-			}
-			if err := jsonutil.WriteJSON(fmt.Sprintf(proofFmt, step), proof, OutFilePerm); err != nil {
-				return fmt.Errorf("failed to write proof data: %w", err)
-			}
-		} else {
-			_, err = stepFn(false)
-			if err != nil {
-				return fmt.Errorf("failed at step %d (PC: %08x): %w", step, state.PC, err)
-			}
+		snapshotStore, err = snapshot.OpenStore(snapshotDir, filepath.Base(snapshotFmt), retention)
+		if err != nil {
+			return fmt.Errorf("failed to open snapshot dir: %w", err)
 		}
+	}
 
-		if preimageRead := state.PreimageOffset > prevPreimageOffset; preimageRead {
-			if stopAtAnyPreimage {
-				break
-			}
-			if state.PreimageKey[0] == byte(stopAtPreimageTypeByte) {
-				break
-			}
-			if stopAtPreimageLargerThan != 0 && len(us.LastPreimage()) > stopAtPreimageLargerThan {
-				break
-			}
+	h := &runHooks{
+		l:           l,
+		meta:        meta,
+		m:           m,
+		us:          us,
+		start:       time.Now(),
+		startStep:   state.Step,
+		infoAt:      stepMatcher(ctx, cannon.RunInfoAtFlag.Name),
+		stopAt:      stepMatcher(ctx, cannon.RunStopAtFlag.Name),
+		panics:      newPanicDetector(meta),
+		stopAtPanic: ctx.Bool(RunStopAtPanicFlag.Name),
+		watchStop:   ctx.Bool(RunWatchStopFlag.Name),
+		snapshots:   snapshotWriter(ctx, snapshotStore),
+		proofAt:     stepMatcher(ctx, cannon.RunProofAtFlag.Name),
+		proofFmt:    ctx.String(cannon.RunProofFmtFlag.Name),
+		hashEnc:     json.NewEncoder(hashOut),
+		counters:    counters,
+		counter:     counter,
+		errTail:     errTail,
+	}
+	if ctx.Path(RunCoverageFlag.Name) != "" {
+		h.coverageHits = make(map[uint64]uint64)
+	}
+	opts := fast.RunOptions{
+		StopAtPreimage: stopAtPreimage,
+		MaxSteps:       ctx.Uint64(RunMaxStepsFlag.Name),
+		MaxDuration:    ctx.Duration(RunMaxDurationFlag.Name),
+		SnapshotAt:     stepMatcher(ctx, cannon.RunSnapshotAtFlag.Name),
+		HashAt:         stepMatcher(ctx, RunHashAtFlag.Name),
+		OnSnapshot:     h.onSnapshot,
+		OnProof:        h.onProof,
+		OnHash:         h.onHash,
+	}
+	// only set the matchers and callbacks that are needed, the runner skips the others
+	if h.stopAt != nil || h.panics != nil {
+		opts.StopAt = h.stopAtOrPanic
+	}
+	if len(watchpoints) > 0 {
+		opts.StopAfter = h.stopAfterWatchHit
+	}
+	if h.proofAt != nil {
+		opts.ProofAt = h.proofAtTimed
+	}
+	if m != nil || h.infoAt != nil || h.coverageHits != nil {
+		opts.OnStep = h.onStep
+	}
+	m.RecordProgress(state)
+
+	// interrupted is set when the run is canceled, e.g. by SIGINT or SIGTERM.
+	// The current step is completed, and the state is written before returning the interrupt error.
+	var interrupted error
+	reason, runErr := fast.NewRunner(us, opts).Run(ctx.Context)
+	h.wallTime = time.Since(h.start)
+	switch reason {
+	case fast.StopFailed:
+		if exitErr := po.ExitErr(); exitErr != nil {
+			runErr = fmt.Errorf("%w, resulting in err %w", exitErr, runErr)
+		}
+		// the reports are written up to the failed step, but not the output state
+		if err := h.writeReports(ctx, state, runErr); err != nil {
+			return errors.Join(runErr, err)
 		}
+		return runErr
+	case fast.StopInterrupted:
+		l.Warn("run interrupted, writing current state", "step", state.Step, "err", runErr)
+		interrupted = runErr
+	case fast.StopMaxDuration:
+		l.Info("reached max duration", "step", state.Step, "duration", ctx.Duration(RunMaxDurationFlag.Name))
+	case fast.StopMaxSteps:
+		l.Info("reached max steps", "step", state.Step, "steps", ctx.Uint64(RunMaxStepsFlag.Name))
 	}
 
-	if err := jsonutil.WriteJSON(ctx.Path(cannon.RunOutputFlag.Name), state, OutFilePerm); err != nil {
+	m.RecordProgress(state)
+
+	outputPath := ctx.Path(cannon.RunOutputFlag.Name)
+	if interruptPath := ctx.Path(RunInterruptSnapshotFlag.Name); interrupted != nil && interruptPath != "" {
+		outputPath = interruptPath
+	}
+	if err := WriteState(outputPath, state, merkleCache); err != nil {
 		return fmt.Errorf("failed to write state output: %w", err)
 	}
-	return nil
+	if interrupted != nil {
+		l.Info("wrote state of interrupted run", "step", state.Step, "path", outputPath)
+	}
+	if err := h.writeReports(ctx, state, nil); err != nil {
+		return err
+	}
+
+	return interrupted
 }
 
 var RunCommand = &cli.Command{
@@ -241,11 +706,36 @@ var RunCommand = &cli.Command{
 		cannon.RunProofFmtFlag,
 		cannon.RunSnapshotAtFlag,
 		cannon.RunSnapshotFmtFlag,
+		RunSnapshotDeltaFlag,
+		RunSnapshotFullAtFlag,
+		RunMerkleCacheFlag,
+		RunHashAtFlag,
+		RunHashOutFlag,
+		RunSnapshotDirFlag,
+		RunSnapshotKeepEveryFlag,
+		RunSnapshotKeepLastFlag,
+		RunResumeFromDirFlag,
+		RunResumeAtFlag,
+		RunInterruptSnapshotFlag,
+		RunMaxStepsFlag,
+		RunMaxDurationFlag,
+		RunSummaryFlag,
+		RunMetricsAddrFlag,
+		RunCoverageFlag,
+		RunCoverageELFFlag,
+		RunCountersFlag,
+		RunWatchFlag,
+		RunWatchStopFlag,
+		RunStraceFlag,
+		RunStrictSyscallsFlag,
+		RunStrictSyscallsPolicyFlag,
+		RunStopAtPanicFlag,
 		cannon.RunStopAtFlag,
 		cannon.RunStopAtPreimageTypeFlag,
 		cannon.RunStopAtPreimageLargerThanFlag,
 		cannon.RunMetaFlag,
 		cannon.RunInfoAtFlag,
 		cannon.RunPProfCPU,
+		RunDecodeCacheFlag,
 	},
 }
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+
+	"github.com/ethereum-optimism/optimism/op-service/ioutil"
+	"github.com/ethereum-optimism/optimism/op-service/jsonutil"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+// stateFile is the file form of a VM state, which may be a delta:
+// a delta state only contains the memory pages that changed since the base state it refers to.
+//
+// States are stored as JSON, or in the binary state format if the path has a ".bin" extension, see fast.VMState.Serialize.
+// Either format is gzip-compressed if the path has an additional ".gz" extension.
+// In the binary form the base path follows the state, as uint32 length-prefixed string.
+type stateFile struct {
+	fast.VMState
+	// path of the base state, relative to the directory of the delta state. Empty if not a delta.
+	Base string `json:"base,omitempty"`
+	// optional memory merkle cache of a full state, see fast.Memory.SerializeMerkleCache. Part of the binary state format itself.
+	MerkleCache hexutil.Bytes `json:"merkleCache,omitempty"`
+}
+
+// IsBinaryStatePath returns true if the state at the path is stored in the binary state format.
+func IsBinaryStatePath(path string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".bin")
+}
+
+func loadStateFile(path string) (*stateFile, error) {
+	if !IsBinaryStatePath(path) {
+		f, err := jsonutil.LoadJSON[stateFile](path)
+		if err != nil {
+			return nil, err
+		}
+		if len(f.MerkleCache) > 0 {
+			if err := f.Memory.DeserializeMerkleCache(bytes.NewReader(f.MerkleCache)); err != nil {
+				return nil, fmt.Errorf("failed to restore merkle cache of %q: %w", path, err)
+			}
+			f.MerkleCache = nil
+		}
+		return f, nil
+	}
+	r, err := ioutil.OpenDecompressed(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %q: %w", path, err)
+	}
+	defer r.Close()
+	var f stateFile
+	if err := f.VMState.Deserialize(r); err != nil {
+		return nil, fmt.Errorf("failed to decode file %q: %w", path, err)
+	}
+	var tmp [4]byte
+	if _, err := io.ReadFull(r, tmp[:]); errors.Is(err, io.EOF) {
+		return &f, nil // not a delta
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read base path length of %q: %w", path, err)
+	}
+	base := make([]byte, binary.BigEndian.Uint32(tmp[:]))
+	if _, err := io.ReadFull(r, base); err != nil {
+		return nil, fmt.Errorf("failed to read base path of %q: %w", path, err)
+	}
+	f.Base = string(base)
+	return &f, nil
+}
+
+func writeStateFile(path string, f *stateFile, withMerkleCache bool) error {
+	if withMerkleCache {
+		// merkleize the pages that changed in parallel, the cache then only has to be copied
+		_ = f.Memory.MerkleRootParallel(runtime.NumCPU())
+	}
+	if !IsBinaryStatePath(path) {
+		if withMerkleCache {
+			var buf bytes.Buffer
+			if err := f.Memory.SerializeMerkleCache(&buf); err != nil {
+				return fmt.Errorf("failed to encode merkle cache: %w", err)
+			}
+			f.MerkleCache = buf.Bytes()
+		}
+		return jsonutil.WriteJSON(path, f, OutFilePerm)
+	}
+	var out io.Writer
+	finish := func() error { return nil }
+	if path != "-" {
+		w, err := ioutil.NewAtomicWriterCompressed(path, OutFilePerm)
+		if err != nil {
+			return fmt.Errorf("failed to open output file: %w", err)
+		}
+		defer w.Close()
+		out = w
+		// closing renames the file to its final destination
+		finish = w.Close
+	} else {
+		out = os.Stdout
+	}
+	serialize := f.VMState.Serialize
+	if withMerkleCache {
+		serialize = f.VMState.SerializeWithMerkleCache
+	}
+	if err := serialize(out); err != nil {
+		return fmt.Errorf("failed to encode binary state: %w", err)
+	}
+	if f.Base != "" {
+		var tmp [4]byte
+		binary.BigEndian.PutUint32(tmp[:], uint32(len(f.Base)))
+		if _, err := out.Write(append(tmp[:], f.Base...)); err != nil {
+			return fmt.Errorf("failed to write base path: %w", err)
+		}
+	}
+	if err := finish(); err != nil {
+		return fmt.Errorf("failed to finish write: %w", err)
+	}
+	return nil
+}
+
+// LoadState loads a VM state, and applies it to its base state if it is a delta state.
+func LoadState(path string) (*fast.VMState, error) {
+	f, err := loadStateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.Base == "" {
+		return &f.VMState, nil
+	}
+	basePath := f.Base
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(filepath.Dir(path), basePath)
+	}
+	base, err := LoadState(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load base state of delta %q: %w", path, err)
+	}
+	if base.Step > f.Step {
+		return nil, fmt.Errorf("base state %q at step %d is ahead of delta %q at step %d", basePath, base.Step, path, f.Step)
+	}
+	_ = f.Memory.ForEachPage(func(pageIndex uint64, page *fast.Page) error {
+		base.Memory.SetPage(pageIndex, page)
+		return nil
+	})
+	out := f.VMState
+	out.Memory = base.Memory
+	return &out, nil
+}
+
+// WriteState writes the full VM state, in the format selected by the path extension.
+// The state is not written if the path is empty, and written to stdout if the path is "-".
+// If withMerkleCache is true, the memory merkle cache is included, so the state can be hashed right after loading it.
+func WriteState(path string, state *fast.VMState, withMerkleCache bool) error {
+	if path == "" {
+		return nil
+	}
+	return writeStateFile(path, &stateFile{VMState: *state}, withMerkleCache)
+}
+
+// WriteStateDelta writes the state as a delta of the base state at basePath:
+// only the memory pages that changed since the base state, as tracked by the memory dirty pages, are included.
+// Delta states do not include the memory merkle cache.
+func WriteStateDelta(path string, state *fast.VMState, basePath string) error {
+	base, err := filepath.Abs(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve base state path: %w", err)
+	}
+	if dir, err := filepath.Abs(filepath.Dir(path)); err == nil {
+		if rel, err := filepath.Rel(dir, base); err == nil {
+			base = rel
+		}
+	}
+	f := &stateFile{VMState: *state, Base: base}
+	f.Memory = state.Memory.CopyPages(state.Memory.DirtyPages())
+	return writeStateFile(path, f, false)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+// straceWriter writes the syscalls of a run to the --strace file, one line per syscall, formatted like:
+//
+//	<step> <pc> <symbol>: <name>(<a0>, ..., <a5>) = <ret>, err <err>
+//
+// or, for a syscall that the VM does not support, which fails the step:
+//
+//	<step> <pc> <symbol>: <name>(<a0>, ..., <a5>) failed: <failure>
+type straceWriter struct {
+	fast.NoopTracer
+	w    *bufio.Writer
+	meta *Metadata
+	// err is the first write error, nothing is written after it
+	err error
+}
+
+var _ fast.Tracer = (*straceWriter)(nil)
+
+func newStraceWriter(w io.Writer, meta *Metadata) *straceWriter {
+	return &straceWriter{w: bufio.NewWriter(w), meta: meta}
+}
+
+func (s *straceWriter) OnSyscall(rec *fast.SyscallRecord) {
+	if s.err != nil {
+		return
+	}
+	if _, s.err = fmt.Fprintf(s.w, "%d %08x %s: %s(%#x, %#x, %#x, %#x, %#x, %#x)",
+		rec.Step, rec.PC, s.meta.LookupSymbol(rec.PC), fast.SyscallName(rec.Num),
+		rec.Args[0], rec.Args[1], rec.Args[2], rec.Args[3], rec.Args[4], rec.Args[5]); s.err != nil {
+		return
+	}
+	if rec.Failure != "" {
+		_, s.err = fmt.Fprintf(s.w, " failed: %s\n", rec.Failure)
+	} else {
+		_, s.err = fmt.Fprintf(s.w, " = %#x, err %#x\n", rec.Ret, rec.Err)
+	}
+}
+
+// Flush writes the buffered lines, and returns the first write error, if any.
+func (s *straceWriter) Flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.w.Flush()
+}
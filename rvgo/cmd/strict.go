@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+// ParseSyscallPolicy parses a strict syscall policy: "off", "warn" or "error".
+func ParseSyscallPolicy(s string) (fast.SyscallPolicy, error) {
+	switch s {
+	case "off":
+		return fast.SyscallAllow, nil
+	case "warn":
+		return fast.SyscallWarn, nil
+	case "error":
+		return fast.SyscallFail, nil
+	default:
+		return 0, fmt.Errorf("invalid syscall policy %q, expected off, warn or error", s)
+	}
+}
+
+// ParseStrictSyscalls parses the default strict syscall policy, and the per-syscall overrides in the format name=policy,
+// e.g. "madvise=off". A syscall may also be given by number. It returns nil if strict mode is off for all syscalls.
+func ParseStrictSyscalls(defaultPolicy string, overrides []string) (*fast.StrictSyscalls, error) {
+	def, err := ParseSyscallPolicy(defaultPolicy)
+	if err != nil {
+		return nil, err
+	}
+	strict := &fast.StrictSyscalls{Default: def, Policies: make(map[uint64]fast.SyscallPolicy)}
+	enabled := def != fast.SyscallAllow
+	for _, o := range overrides {
+		name, policyStr, ok := strings.Cut(o, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid syscall policy override %q, expected name=policy", o)
+		}
+		num, ok := fast.SyscallNumber(name)
+		if !ok {
+			if num, err = strconv.ParseUint(name, 0, 64); err != nil {
+				return nil, fmt.Errorf("unknown syscall %q", name)
+			}
+		}
+		policy, err := ParseSyscallPolicy(policyStr)
+		if err != nil {
+			return nil, err
+		}
+		strict.Policies[num] = policy
+		enabled = enabled || policy != fast.SyscallAllow
+	}
+	if !enabled {
+		return nil, nil
+	}
+	return strict, nil
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+func TestParseStrictSyscalls(t *testing.T) {
+	t.Run("off", func(t *testing.T) {
+		strict, err := ParseStrictSyscalls("off", nil)
+		require.NoError(t, err)
+		require.Nil(t, strict)
+
+		strict, err = ParseStrictSyscalls("off", []string{"madvise=off"})
+		require.NoError(t, err)
+		require.Nil(t, strict, "off for all syscalls")
+	})
+
+	t.Run("default", func(t *testing.T) {
+		strict, err := ParseStrictSyscalls("warn", nil)
+		require.NoError(t, err)
+		require.Equal(t, fast.SyscallWarn, strict.Default)
+		require.Empty(t, strict.Policies)
+
+		strict, err = ParseStrictSyscalls("error", nil)
+		require.NoError(t, err)
+		require.Equal(t, fast.SyscallFail, strict.Default)
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		strict, err := ParseStrictSyscalls("off", []string{"madvise=error", "clock_gettime=warn", "261=warn", "0x65=off"})
+		require.NoError(t, err)
+		require.Equal(t, fast.SyscallAllow, strict.Default)
+		require.Equal(t, map[uint64]fast.SyscallPolicy{
+			233: fast.SyscallFail,
+			113: fast.SyscallWarn,
+			261: fast.SyscallWarn,
+			101: fast.SyscallAllow,
+		}, strict.Policies)
+	})
+
+	t.Run("names", func(t *testing.T) {
+		for _, num := range fast.CheckedSyscalls() {
+			name := fast.SyscallName(num)
+			strict, err := ParseStrictSyscalls("off", []string{name + "=warn"})
+			require.NoError(t, err, "override of %s", name)
+			require.Equal(t, map[uint64]fast.SyscallPolicy{num: fast.SyscallWarn}, strict.Policies, "override of %s", name)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseStrictSyscalls("loud", nil)
+		require.ErrorContains(t, err, `invalid syscall policy "loud"`)
+		_, err = ParseStrictSyscalls("warn", []string{"madvise"})
+		require.ErrorContains(t, err, "expected name=policy")
+		_, err = ParseStrictSyscalls("warn", []string{"fork=off"})
+		require.ErrorContains(t, err, `unknown syscall "fork"`)
+		_, err = ParseStrictSyscalls("warn", []string{"madvise=on"})
+		require.ErrorContains(t, err, `invalid syscall policy "on"`)
+	})
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	preimage "github.com/ethereum-optimism/optimism/op-preimage"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+// RunSummary is the report of a run, as written to the --summary file.
+type RunSummary struct {
+	Steps    uint64  `json:"steps"`
+	WallTime float64 `json:"wallTimeSeconds"`
+	IPS      float64 `json:"ips"`
+
+	// Status is the VM status of the final state, as committed to in the first byte of the state hash.
+	Status    uint8       `json:"vmStatus"`
+	Exited    bool        `json:"exited"`
+	ExitCode  uint8       `json:"exitCode"`
+	FinalStep uint64      `json:"finalStep"`
+	FinalHash common.Hash `json:"finalHash"`
+
+	PeakPages int `json:"peakPages"`
+
+	// Preimages are the pre-image fetch statistics, by key type
+	Preimages map[string]*PreimageStats `json:"preimages"`
+	Hints     uint64                    `json:"hints"`
+
+	// StdErrTail is the tail of the std-err output of the program
+	StdErrTail string `json:"stdErrTail"`
+
+	// Panic is the last Go panic or fatal error of the program, if any
+	Panic *GuestPanic `json:"panic,omitempty"`
+
+	// Error is the error that the run failed with, if it failed. The final state is that of the failed step.
+	Error string `json:"error,omitempty"`
+}
+
+type PreimageStats struct {
+	Count uint64 `json:"count"`
+	Bytes uint64 `json:"bytes"`
+}
+
+func preimageKeyTypeName(typ byte) string {
+	switch preimage.KeyType(typ) {
+	case preimage.LocalKeyType:
+		return "local"
+	case preimage.Keccak256KeyType:
+		return "keccak"
+	case preimage.GlobalGenericKeyType:
+		return "generic"
+	case preimage.Sha256KeyType:
+		return "sha256"
+	case preimage.BlobKeyType:
+		return "blob"
+	default:
+		return fmt.Sprintf("type-%d", typ)
+	}
+}
+
+// countingOracle wraps a pre-image oracle, to count the pre-image fetches and hints of a run.
+type countingOracle struct {
+	fast.PreimageOracle
+	preimages map[string]*PreimageStats
+	hints     uint64
+}
+
+var _ fast.PreimageOracle = (*countingOracle)(nil)
+
+func newCountingOracle(po fast.PreimageOracle) *countingOracle {
+	return &countingOracle{PreimageOracle: po, preimages: make(map[string]*PreimageStats)}
+}
+
+func (o *countingOracle) Hint(v []byte) {
+	o.hints++
+	o.PreimageOracle.Hint(v)
+}
+
+func (o *countingOracle) GetPreimage(k [32]byte) []byte {
+	v := o.PreimageOracle.GetPreimage(k)
+	name := preimageKeyTypeName(k[0])
+	stats, ok := o.preimages[name]
+	if !ok {
+		stats = new(PreimageStats)
+		o.preimages[name] = stats
+	}
+	stats.Count++
+	stats.Bytes += uint64(len(v))
+	return v
+}
+
+// tailWriter passes writes through to the underlying writer,
+// and keeps the last bytes that were written, up to its size.
+type tailWriter struct {
+	w    io.Writer
+	size int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newTailWriter(w io.Writer, size int) *tailWriter {
+	return &tailWriter{w: w, size: size}
+}
+
+func (t *tailWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	t.buf = append(t.buf, b...)
+	if over := len(t.buf) - t.size; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	t.mu.Unlock()
+	return t.w.Write(b)
+}
+
+func (t *tailWriter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
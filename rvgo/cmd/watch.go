@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+// ParseWatchpoint parses a watchpoint in the format addr[:len][:rw], e.g. "0x8000:8:w".
+// The address and length may be hex with a 0x prefix, or decimal. The length defaults to 1 byte.
+// The mode is "r" for loads, "w" for stores, or "rw" for both, which is the default.
+func ParseWatchpoint(s string) (fast.Watchpoint, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return fast.Watchpoint{}, fmt.Errorf("invalid watchpoint %q, expected addr[:len][:rw]", s)
+	}
+	addr, err := strconv.ParseUint(parts[0], 0, 64)
+	if err != nil {
+		return fast.Watchpoint{}, fmt.Errorf("invalid watchpoint address %q: %w", parts[0], err)
+	}
+	w := fast.Watchpoint{Addr: addr, Len: 1, Read: true, Write: true}
+	parts = parts[1:]
+	if len(parts) > 0 && strings.Trim(parts[0], "rw") != "" {
+		w.Len, err = strconv.ParseUint(parts[0], 0, 64)
+		if err != nil || w.Len == 0 {
+			return fast.Watchpoint{}, fmt.Errorf("invalid watchpoint length %q", parts[0])
+		}
+		if w.Addr+(w.Len-1) < w.Addr {
+			return fast.Watchpoint{}, fmt.Errorf("invalid watchpoint %q, range exceeds the address space", s)
+		}
+		parts = parts[1:]
+	}
+	if len(parts) > 0 {
+		switch parts[0] {
+		case "r":
+			w.Write = false
+		case "w":
+			w.Read = false
+		case "rw", "wr":
+		default:
+			return fast.Watchpoint{}, fmt.Errorf("invalid watchpoint mode %q, expected r, w or rw", parts[0])
+		}
+		if len(parts) > 1 {
+			return fast.Watchpoint{}, fmt.Errorf("invalid watchpoint %q, expected addr[:len][:rw]", s)
+		}
+	}
+	return w, nil
+}
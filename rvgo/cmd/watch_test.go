@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+func TestParseWatchpoint(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		out fast.Watchpoint
+	}{
+		{"0x8000", fast.Watchpoint{Addr: 0x8000, Len: 1, Read: true, Write: true}},
+		{"32768", fast.Watchpoint{Addr: 0x8000, Len: 1, Read: true, Write: true}},
+		{"0x8000:8", fast.Watchpoint{Addr: 0x8000, Len: 8, Read: true, Write: true}},
+		{"0x8000:0x10:r", fast.Watchpoint{Addr: 0x8000, Len: 16, Read: true}},
+		{"0x8000:8:w", fast.Watchpoint{Addr: 0x8000, Len: 8, Write: true}},
+		{"0x8000:w", fast.Watchpoint{Addr: 0x8000, Len: 1, Write: true}},
+		{"0x8000:wr", fast.Watchpoint{Addr: 0x8000, Len: 1, Read: true, Write: true}},
+		{"0xfffffffffffffff8:8", fast.Watchpoint{Addr: 0xffff_ffff_ffff_fff8, Len: 8, Read: true, Write: true}},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			w, err := ParseWatchpoint(tc.in)
+			require.NoError(t, err)
+			require.Equal(t, tc.out, w)
+		})
+	}
+
+	for _, tc := range []struct {
+		in  string
+		err string
+	}{
+		{"", "invalid watchpoint address"},
+		{"foo", "invalid watchpoint address"},
+		{"0x8000:0", "invalid watchpoint length"},
+		{"0x8000:-1", "invalid watchpoint length"},
+		{"0x8000:8:x", "invalid watchpoint mode"},
+		{"0x8000:8:r:w", "expected addr[:len][:rw]"},
+		{"0x8000:r:w", "expected addr[:len][:rw]"},
+		{"0xfffffffffffffff8:9", "range exceeds the address space"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			_, err := ParseWatchpoint(tc.in)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -3,22 +3,20 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"runtime"
 
 	cannon "github.com/ethereum-optimism/optimism/cannon/cmd"
-	"github.com/ethereum-optimism/optimism/op-service/jsonutil"
 	"github.com/urfave/cli/v2"
-
-	"github.com/ethereum-optimism/asterisc/rvgo/fast"
 )
 
 func Witness(ctx *cli.Context) error {
 	input := ctx.Path(cannon.WitnessInputFlag.Name)
 	output := ctx.Path(cannon.WitnessOutputFlag.Name)
-	state, err := jsonutil.LoadJSON[fast.VMState](input)
+	state, err := LoadState(input)
 	if err != nil {
 		return fmt.Errorf("invalid input state (%v): %w", input, err)
 	}
-	witness := state.EncodeWitness()
+	witness := state.EncodeWitnessParallel(runtime.NumCPU())
 	h, err := witness.StateHash()
 	if err != nil {
 		return fmt.Errorf("failed to compute witness hash: %w", err)
@@ -34,8 +32,8 @@ func Witness(ctx *cli.Context) error {
 
 var WitnessCommand = &cli.Command{
 	Name:        "witness",
-	Usage:       "Convert an Asterisc JSON state into a binary witness",
-	Description: "Convert an Asterisc JSON state into a binary witness. The hash of the witness is written to stdout",
+	Usage:       "Convert an Asterisc state into a binary witness",
+	Description: "Convert an Asterisc JSON or binary state into a binary witness. The hash of the witness is written to stdout",
 	Action:      Witness,
 	Flags: []cli.Flag{
 		cannon.WitnessInputFlag,
@@ -0,0 +1,224 @@
+package fast
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// instrKeyBits is the number of bits of an instruction key: 7 bits opcode, 3 bits funct3, 7 bits funct7.
+const instrKeyBits = 7 + 3 + 7
+
+// Counters count how often the code paths of the VM are executed:
+// instruction encodings, syscalls, and the patterns of memory proofs that steps use.
+// Counting is opt-in with InstrumentedState.SetCounters, since it slows down execution,
+// and disables the decode cache, so all instructions run through the same code path as proof generation.
+type Counters struct {
+	instructions [1 << instrKeyBits]uint64
+	syscalls     map[uint64]uint64
+	// proof patterns are keyed by the memory accesses of a step,
+	// encoded as pairs of the access kind ('r' or 'w') and '0' plus the proof index
+	proofPatterns map[string]*uint64
+
+	// memory accesses of the current step
+	pattern []byte
+}
+
+func NewCounters() *Counters {
+	return &Counters{
+		syscalls:      make(map[uint64]uint64),
+		proofPatterns: make(map[string]*uint64),
+	}
+}
+
+// InstrCount is the number of executions of an instruction encoding.
+// Funct3 and Funct7 are zero for instructions that do not use them.
+type InstrCount struct {
+	Opcode uint8  `json:"opcode"`
+	Funct3 uint8  `json:"funct3"`
+	Funct7 uint8  `json:"funct7"`
+	Count  uint64 `json:"count"`
+}
+
+type SyscallCount struct {
+	Num   uint64 `json:"num"`
+	Count uint64 `json:"count"`
+}
+
+// ProofPatternCount is the number of steps with a pattern of memory accesses.
+// The pattern lists the memory proofs of the step in order: "r" for a read that is proven,
+// "w" for a write that reuses a proof, followed by the proof index. The pattern is empty for steps without memory proofs.
+type ProofPatternCount struct {
+	Pattern string `json:"pattern"`
+	Count   uint64 `json:"count"`
+}
+
+// CountersJSON is the JSON encoding of Counters, sorted by count, most frequent first.
+type CountersJSON struct {
+	Instructions  []InstrCount        `json:"instructions"`
+	Syscalls      []SyscallCount      `json:"syscalls"`
+	ProofPatterns []ProofPatternCount `json:"proofPatterns"`
+}
+
+// instrKey normalizes the fields of the instruction to the fields that the opcode uses,
+// so the fields of immediates do not count as different encodings.
+func instrKey(opcode, funct3, funct7 U64) uint32 {
+	switch opcode {
+	case 0x37, 0x17, 0x6F: // LUI, AUIPC, JAL
+		funct3, funct7 = 0, 0
+	case 0x13: // OP-IMM: only shifts have a funct6, the lowest bit of funct7 is part of the 6-bit shamt
+		if funct3 == 1 || funct3 == 5 {
+			funct7 &^= 1
+		} else {
+			funct7 = 0
+		}
+	case 0x1B: // OP-IMM-32: only shifts have a funct7
+		if funct3 != 1 && funct3 != 5 {
+			funct7 = 0
+		}
+	case 0x2F: // AMO: funct5, the lower 2 bits are the aq and rl flags
+		funct7 &^= 3
+	case 0x33, 0x3B: // OP, OP-32
+	default:
+		funct7 = 0
+	}
+	return uint32(opcode&0x7F)<<10 | uint32(funct3&7)<<7 | uint32(funct7&0x7F)
+}
+
+func (c *Counters) countInstr(opcode, funct3, funct7 U64) {
+	c.instructions[instrKey(opcode, funct3, funct7)]++
+}
+
+func (c *Counters) countSyscall(num U64) {
+	c.syscalls[num]++
+}
+
+func (c *Counters) countMemAccess(write bool, proofIndex uint8) {
+	kind := byte('r')
+	if write {
+		kind = 'w'
+	}
+	c.pattern = append(c.pattern, kind, '0'+proofIndex)
+}
+
+// countStepEnd counts the memory proof pattern of the step.
+func (c *Counters) countStepEnd() {
+	if n, ok := c.proofPatterns[string(c.pattern)]; ok { // lookup without allocation
+		*n++
+		return
+	}
+	n := uint64(1)
+	c.proofPatterns[string(c.pattern)] = &n
+}
+
+// Merge adds the counts of other to c.
+func (c *Counters) Merge(other *Counters) {
+	for i, n := range other.instructions {
+		c.instructions[i] += n
+	}
+	for num, n := range other.syscalls {
+		c.syscalls[num] += n
+	}
+	for p, n := range other.proofPatterns {
+		if cn, ok := c.proofPatterns[p]; ok {
+			*cn += *n
+		} else {
+			v := *n
+			c.proofPatterns[p] = &v
+		}
+	}
+}
+
+func (c *Counters) Instructions() []InstrCount {
+	var out []InstrCount
+	for key, n := range c.instructions {
+		if n == 0 {
+			continue
+		}
+		out = append(out, InstrCount{
+			Opcode: uint8(key >> 10),
+			Funct3: uint8(key>>7) & 7,
+			Funct7: uint8(key) & 0x7F,
+			Count:  n,
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	return out
+}
+
+func (c *Counters) Syscalls() []SyscallCount {
+	out := make([]SyscallCount, 0, len(c.syscalls))
+	for num, n := range c.syscalls {
+		out = append(out, SyscallCount{Num: num, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Num < out[j].Num
+	})
+	return out
+}
+
+func (c *Counters) ProofPatterns() []ProofPatternCount {
+	out := make([]ProofPatternCount, 0, len(c.proofPatterns))
+	for p, n := range c.proofPatterns {
+		var pattern strings.Builder
+		for i := 0; i+1 < len(p); i += 2 {
+			if i > 0 {
+				pattern.WriteByte(' ')
+			}
+			pattern.WriteByte(p[i])
+			pattern.WriteString(strconv.Itoa(int(p[i+1] - '0')))
+		}
+		out = append(out, ProofPatternCount{Pattern: pattern.String(), Count: *n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Pattern < out[j].Pattern
+	})
+	return out
+}
+
+func (c *Counters) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&CountersJSON{
+		Instructions:  c.Instructions(),
+		Syscalls:      c.Syscalls(),
+		ProofPatterns: c.ProofPatterns(),
+	})
+}
+
+func (c *Counters) UnmarshalJSON(data []byte) error {
+	var v CountersJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = *NewCounters()
+	for _, ic := range v.Instructions {
+		c.instructions[instrKey(U64(ic.Opcode), U64(ic.Funct3), U64(ic.Funct7))] += ic.Count
+	}
+	for _, sc := range v.Syscalls {
+		c.syscalls[sc.Num] += sc.Count
+	}
+	for _, pc := range v.ProofPatterns {
+		var p []byte
+		for _, access := range strings.Fields(pc.Pattern) {
+			index, err := strconv.ParseUint(access[1:], 10, 8)
+			if err != nil || (access[0] != 'r' && access[0] != 'w') {
+				return fmt.Errorf("invalid proof pattern %q", pc.Pattern)
+			}
+			p = append(p, access[0], '0'+byte(index))
+		}
+		n := pc.Count
+		if cn, ok := c.proofPatterns[string(p)]; ok {
+			*cn += n
+		} else {
+			c.proofPatterns[string(p)] = &n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package fast
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounters(t *testing.T) {
+	// the counter program, exiting when the counter reaches 50
+	newState := func() *VMState {
+		state := newTestState(counterProgram)
+		state.Registers[11] = 0x8000
+		state.Registers[12] = 50
+		return state
+	}
+
+	refState := newState()
+	ref := NewInstrumentedState(refState, nil, nil, nil)
+	ref.SetDecodeCache(true)
+	require.NoError(t, ref.RunUntil(context.Background(), nil))
+
+	state := newState()
+	us := NewInstrumentedState(state, nil, nil, nil)
+	us.SetDecodeCache(true)
+	c := NewCounters()
+	us.SetCounters(c)
+	_, err := us.Step(true) // counted with proof generation too
+	require.NoError(t, err)
+	require.NoError(t, us.RunUntil(context.Background(), nil))
+	require.Equal(t, refState.EncodeWitness(), state.EncodeWitness())
+
+	require.Equal(t, []InstrCount{
+		{Opcode: 0x13, Count: 51},
+		{Opcode: 0x23, Funct3: 3, Count: 50},
+		{Opcode: 0x63, Funct3: 4, Count: 50},
+		{Opcode: 0x73, Count: 1},
+	}, c.Instructions())
+	require.Equal(t, []SyscallCount{{Num: 93, Count: 1}}, c.Syscalls())
+	require.Equal(t, []ProofPatternCount{
+		{Pattern: "r0", Count: 102},
+		{Pattern: "r0 r1 w1", Count: 50},
+	}, c.ProofPatterns())
+
+	dat, err := json.Marshal(c)
+	require.NoError(t, err)
+	var decoded Counters
+	require.NoError(t, json.Unmarshal(dat, &decoded))
+	decoded.Merge(c)
+	require.Equal(t, []SyscallCount{{Num: 93, Count: 2}}, decoded.Syscalls())
+	require.Equal(t, []ProofPatternCount{
+		{Pattern: "r0", Count: 204},
+		{Pattern: "r0 r1 w1", Count: 100},
+	}, decoded.ProofPatterns())
+}
@@ -0,0 +1,249 @@
+package fast
+
+// Predecoding of instructions, for faster non-proof execution.
+//
+// Only the common, well-formed, instructions are predecoded.
+// Anything else (system calls, CSRs, atomics, malformed encodings) decodes to opFallback,
+// and is executed by the regular riscvStep, which remains the reference implementation.
+
+type decodedOp uint8
+
+const (
+	opFallback decodedOp = iota // execute with riscvStep
+	opNop                       // only advances the PC
+
+	opLoad
+	opStore
+	opBranch
+
+	opADDI
+	opSLLI
+	opSLTI
+	opSLTIU
+	opXORI
+	opSRLI
+	opSRAI
+	opORI
+	opANDI
+
+	opADDIW
+	opSLLIW
+	opSRLIW
+	opSRAIW
+
+	opADD
+	opSUB
+	opSLL
+	opSLT
+	opSLTU
+	opXOR
+	opSRL
+	opSRA
+	opOR
+	opAND
+
+	opMUL
+	opMULH
+	opMULHSU
+	opMULHU
+	opDIV
+	opDIVU
+	opREM
+	opREMU
+
+	opADDW
+	opSUBW
+	opSLLW
+	opSRLW
+	opSRAW
+
+	opMULW
+	opDIVW
+	opDIVUW
+	opREMW
+	opREMUW
+
+	opLUI
+	opAUIPC
+	opJAL
+	opJALR
+)
+
+// decodedInstr is the predecoded form of an instruction.
+// The immediate is fully prepared: sign-extended, and shifted where applicable.
+type decodedInstr struct {
+	op     decodedOp
+	rd     uint8
+	rs1    uint8
+	rs2    uint8
+	funct3 uint8 // branch condition
+	size   uint8 // load/store size in bytes
+	signed bool  // sign-extend loaded value
+	imm    U64
+}
+
+// decodedPage caches the predecoded instructions of a page of memory.
+// The cache is reset when the page is written to.
+type decodedPage struct {
+	instrs [PageSize / 4]decodedInstr
+	ok     [PageSize / 4]bool
+}
+
+// decodeInstr decodes the instruction into a form that executes the exact same as riscvStep.
+func decodeInstr(instr U64) (out decodedInstr) {
+	opcode := parseOpcode(instr)
+	funct3 := parseFunct3(instr)
+	funct7 := parseFunct7(instr)
+	out.rd = uint8(parseRd(instr))
+	out.rs1 = uint8(parseRs1(instr))
+	out.rs2 = uint8(parseRs2(instr))
+	out.funct3 = uint8(funct3)
+
+	switch opcode {
+	case 0x03: // 000_0011: memory loading
+		out.op = opLoad
+		out.imm = signExtend64(parseImmTypeI(instr), toU64(11))
+		out.signed = iszero64(and64(funct3, toU64(4)))
+		out.size = uint8(shl64(and64(funct3, toU64(3)), toU64(1)))
+	case 0x23: // 010_0011: memory storing
+		if funct3 > 3 { // larger than 8 bytes
+			return
+		}
+		out.op = opStore
+		out.imm = signExtend64(parseImmTypeS(instr), toU64(11))
+		out.size = uint8(shl64(funct3, toU64(1)))
+	case 0x63: // 110_0011: branching
+		out.op = opBranch
+		out.imm = parseImmTypeB(instr)
+	case 0x13: // 001_0011: immediate arithmetic and logic
+		imm := parseImmTypeI(instr)
+		out.imm = imm
+		switch funct3 {
+		case 0:
+			out.op = opADDI
+		case 1:
+			out.op = opSLLI
+			out.imm = and64(imm, toU64(0x3F))
+		case 2:
+			out.op = opSLTI
+		case 3:
+			out.op = opSLTIU
+		case 4:
+			out.op = opXORI
+		case 5:
+			out.imm = and64(imm, toU64(0x3F))
+			switch shr64(toU64(6), imm) {
+			case 0x00:
+				out.op = opSRLI
+			case 0x10:
+				out.op = opSRAI
+			}
+		case 6:
+			out.op = opORI
+		case 7:
+			out.op = opANDI
+		}
+	case 0x1B: // 001_1011: immediate arithmetic and logic signed 32 bit
+		imm := parseImmTypeI(instr)
+		switch funct3 {
+		case 0:
+			out.op = opADDIW
+			out.imm = imm
+		case 1:
+			out.op = opSLLIW
+			out.imm = and64(imm, toU64(0x1F))
+		case 5:
+			out.imm = and64(imm, toU64(0x1F))
+			switch shr64(toU64(6), imm) {
+			case 0x00:
+				out.op = opSRLIW
+			case 0x10:
+				out.op = opSRAIW
+			}
+		}
+	case 0x33: // 011_0011: register arithmetic and logic
+		switch funct7 {
+		case 1: // RV M extension
+			out.op = [8]decodedOp{opMUL, opMULH, opMULHSU, opMULHU, opDIV, opDIVU, opREM, opREMU}[funct3]
+		default:
+			switch funct3 {
+			case 0:
+				switch funct7 {
+				case 0x00:
+					out.op = opADD
+				case 0x20:
+					out.op = opSUB
+				}
+			case 1:
+				out.op = opSLL
+			case 2:
+				out.op = opSLT
+			case 3:
+				out.op = opSLTU
+			case 4:
+				out.op = opXOR
+			case 5:
+				switch funct7 {
+				case 0x00:
+					out.op = opSRL
+				case 0x20:
+					out.op = opSRA
+				}
+			case 6:
+				out.op = opOR
+			case 7:
+				out.op = opAND
+			}
+		}
+	case 0x3B: // 011_1011: register arithmetic and logic in 32 bits
+		switch funct7 {
+		case 1: // RV M extension
+			switch funct3 {
+			case 0:
+				out.op = opMULW
+			case 4:
+				out.op = opDIVW
+			case 5:
+				out.op = opDIVUW
+			case 6:
+				out.op = opREMW
+			case 7:
+				out.op = opREMUW
+			}
+		default:
+			switch funct3 {
+			case 0:
+				switch funct7 {
+				case 0x00:
+					out.op = opADDW
+				case 0x20:
+					out.op = opSUBW
+				}
+			case 1:
+				out.op = opSLLW
+			case 5:
+				switch funct7 {
+				case 0x00:
+					out.op = opSRLW
+				case 0x20:
+					out.op = opSRAW
+				}
+			}
+		}
+	case 0x37: // 011_0111: LUI = Load upper immediate
+		out.op = opLUI
+		out.imm = shl64(toU64(12), parseImmTypeU(instr))
+	case 0x17: // 001_0111: AUIPC = Add upper immediate to PC
+		out.op = opAUIPC
+		out.imm = signExtend64(shl64(toU64(12), parseImmTypeU(instr)), toU64(31))
+	case 0x6F: // 110_1111: JAL = Jump and link
+		out.op = opJAL
+		out.imm = signExtend64(shl64(toU64(1), parseImmTypeJ(instr)), toU64(20))
+	case 0x67: // 110_0111: JALR = Jump and link register
+		out.op = opJALR
+		out.imm = signExtend64(parseImmTypeI(instr), toU64(11))
+	case 0x0F, 0x07, 0x27, 0x53: // fence, and no-op floating point instructions
+		out.op = opNop
+	}
+	return
+}
@@ -0,0 +1,24 @@
+package fast
+
+import "encoding/binary"
+
+// counterProgram stores an incrementing counter in a0 to the address in a1, and exits when it reaches a2.
+var counterProgram = []uint32{
+	1<<20 | 10<<15 | 10<<7 | 0x13,  // addi a0, a0, 1
+	10<<20 | 11<<15 | 3<<12 | 0x23, // sd a0, 0(a1)
+	0xfec54ce3,                     // blt a0, a2, -8
+	0x5d00893,                      // addi a7, zero, 93
+	0x73,                           // ecall
+}
+
+// newTestState returns a state with the program loaded at 0x1000, and the PC at its start.
+func newTestState(program []uint32) *VMState {
+	state := NewVMState()
+	state.PC = 0x1000
+	for i, instr := range program {
+		var dat [4]byte
+		binary.LittleEndian.PutUint32(dat[:], instr)
+		state.Memory.SetUnaligned(0x1000+uint64(i)*4, dat[:])
+	}
+	return state
+}
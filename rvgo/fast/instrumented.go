@@ -1,7 +1,9 @@
 package fast
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -19,6 +21,31 @@ type InstrumentedState struct {
 	stdOut io.Writer
 	stdErr io.Writer
 
+	// decodeCache enables execution of predecoded instructions, when not generating proofs
+	decodeCache bool
+
+	// counters, if not nil, count the code paths of executed steps
+	counters *Counters
+
+	// watch, if not nil, records the guest memory accesses of the last step that hit watchpoints
+	watch *watchTracer
+
+	// undo, if not nil, records the state changes of steps, to revert them with StepBack
+	undo *undoLog
+
+	// syscall is the record of the syscall of the step, for the tracer
+	syscall SyscallRecord
+
+	// strict, if not nil, is the policy for emulated syscalls
+	strict *StrictSyscalls
+
+	// tracer, if not nil, is called with the events of executed steps: the tracer of SetTracer, and the watchpoints
+	tracer Tracer
+	// userTracer is the tracer of SetTracer
+	userTracer Tracer
+	// traceData is the buffer of the data that is passed to the tracer
+	traceData [32]byte
+
 	memProofEnabled bool
 	memProofs       [][memProofSize]byte
 	memAccess       []uint64
@@ -42,6 +69,19 @@ func NewInstrumentedState(state *VMState, po PreimageOracle, stdOut, stdErr io.W
 	}
 }
 
+// SetDecodeCache enables or disables the instruction decode cache.
+// When enabled, steps without proof generation run on predecoded instructions,
+// which are cached per memory page, and invalidated when the page is written to.
+func (m *InstrumentedState) SetDecodeCache(enabled bool) {
+	m.decodeCache = enabled
+}
+
+// SetCounters sets the counters to count the code paths of executed steps with, or nil to stop counting.
+// Steps that are counted do not use the decode cache.
+func (m *InstrumentedState) SetCounters(c *Counters) {
+	m.counters = c
+}
+
 func (m *InstrumentedState) Step(proof bool) (wit *StepWitness, err error) {
 	m.memProofEnabled = proof
 	m.memAccess = m.memAccess[:0]
@@ -54,8 +94,7 @@ func (m *InstrumentedState) Step(proof bool) (wit *StepWitness, err error) {
 		}
 	}
 
-	err = m.riscvStep()
-	if err != nil {
+	if err := m.step(m.decodeCache && !proof); err != nil {
 		return nil, err
 	}
 
@@ -73,6 +112,72 @@ func (m *InstrumentedState) Step(proof bool) (wit *StepWitness, err error) {
 	return
 }
 
+// runUntilCtxCheckInterval is the number of steps between context checks in RunUntil,
+// to not do the ctx err check (includes lock) too often.
+const runUntilCtxCheckInterval = 1024
+
+// RunUntil runs steps, without proof generation, until the VM exits,
+// stopFn returns true, or the context is canceled.
+// The stopFn, if not nil, is called with the state before every step, and once with the final state when the VM exits.
+// Steps run on predecoded instructions, without the per-step setup and recovery of Step,
+// but the resulting state is the same as that of repeated Step(false) calls.
+// RunUntil requires the decode cache to be enabled with SetDecodeCache.
+// WatchHits, when called from stopFn, returns the watched memory accesses of the previous step,
+// including those of the final step.
+// Use Step(true) to generate a proof of a step.
+func (m *InstrumentedState) RunUntil(ctx context.Context, stopFn func(state *VMState) bool) error {
+	if !m.decodeCache {
+		return errors.New("RunUntil requires the decode cache")
+	}
+	m.memProofEnabled = false
+	m.memAccess = m.memAccess[:0]
+	m.memProofs = m.memProofs[:0]
+	m.lastPreimageOffset = ^uint64(0)
+	for i := uint64(0); !m.state.Exited; i++ {
+		if i%runUntilCtxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if stopFn != nil && stopFn(m.state) {
+			return nil
+		}
+		if err := m.step(true); err != nil {
+			return err
+		}
+	}
+	if stopFn != nil {
+		stopFn(m.state)
+	}
+	return nil
+}
+
+// step runs a single instruction, on the predecoded instruction if decoded is true.
+// Steps with counters, an undo log or a tracer, which includes watchpoints, always run with riscvStep,
+// which has the hooks for them.
+func (m *InstrumentedState) step(decoded bool) error {
+	if m.state.Exited {
+		return nil
+	}
+	if decoded && m.counters == nil && m.undo == nil && m.tracer == nil {
+		return m.decodedStep()
+	}
+	if m.counters != nil {
+		m.counters.pattern = m.counters.pattern[:0]
+	}
+	if m.undo != nil {
+		m.undo.begin(m.state)
+	}
+	if err := m.riscvStep(); err != nil {
+		return err
+	}
+	if m.counters != nil {
+		// the instruction and syscall are counted by riscvStep, the memory proof pattern when it completes
+		m.counters.countStepEnd()
+	}
+	return nil
+}
+
 func (m *InstrumentedState) readPreimage(key [32]byte, offset uint64) (dat [32]byte, datLen uint64, err error) {
 	preimage := m.lastPreimage
 	if key != m.lastPreimageKey {
@@ -92,6 +197,9 @@ func (m *InstrumentedState) readPreimage(key [32]byte, offset uint64) (dat [32]b
 // trackMemAccess remembers a merkle-branch of memory to the given address,
 // and ensures it comes right after the last memory proof.
 func (m *InstrumentedState) trackMemAccess(effAddr uint64, proofIndex uint8) {
+	if m.counters != nil {
+		m.counters.countMemAccess(false, proofIndex)
+	}
 	if !m.memProofEnabled {
 		return
 	}
@@ -107,6 +215,9 @@ func (m *InstrumentedState) trackMemAccess(effAddr uint64, proofIndex uint8) {
 
 // verifyMemChange verifies a memory change proof reused the last verified mem-proof at the same address
 func (m *InstrumentedState) verifyMemChange(effAddr uint64, proofIndex uint8) {
+	if m.counters != nil {
+		m.counters.countMemAccess(true, proofIndex)
+	}
 	if !m.memProofEnabled {
 		return
 	}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"math/bits"
 	"sort"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/crypto"
 )
@@ -38,11 +39,12 @@ var zeroHashes = func() [256][32]byte {
 }()
 
 type Memory struct {
-	// generalized index -> merkle root or nil if invalidated
-	nodes map[uint64]*[32]byte
+	// merkle nodes above the pages, and the pages in the bottom level, see radixNode
+	radix *radixNode
+	// owner of the radix nodes and pages that the memory may modify in-place
+	owner *cowOwner
 
-	// pageIndex -> cached page
-	pages map[uint64]*CachedPage
+	pageCount int
 
 	// Note: since we don't de-alloc pages, we don't do ref-counting.
 	// Once a page exists, it doesn't leave memory
@@ -51,32 +53,46 @@ type Memory struct {
 	// this prevents map lookups each instruction
 	lastPageKeys [2]uint64
 	lastPage     [2]*CachedPage
+
+	// pageIndex set of pages that were allocated or written to since the last ResetDirty
+	dirty map[uint64]struct{}
 }
 
 func NewMemory() *Memory {
+	owner := new(cowOwner)
 	return &Memory{
-		nodes:        make(map[uint64]*[32]byte),
-		pages:        make(map[uint64]*CachedPage),
+		radix:        &radixNode{owner: owner},
+		owner:        owner,
+		dirty:        make(map[uint64]struct{}),
 		lastPageKeys: [2]uint64{^uint64(0), ^uint64(0)}, // default to invalid keys, to not match any pages
 	}
 }
 
 func (m *Memory) PageCount() int {
-	return len(m.pages)
+	return m.pageCount
 }
 
+// ForEachPage calls fn with the pages of the memory, in ascending page index order.
 func (m *Memory) ForEachPage(fn func(pageIndex uint64, page *Page) error) error {
-	for pageIndex, cachedPage := range m.pages {
-		if err := fn(pageIndex, cachedPage.Data); err != nil {
-			return err
-		}
+	return m.radix.forEachPage(0, 0, func(pageIndex uint64, p *CachedPage) error {
+		return fn(pageIndex, p.Data)
+	})
+}
+
+// page returns the page at the given page index, without updating the lookup cache.
+func (m *Memory) page(pageIndex uint64) (*CachedPage, bool) {
+	n := m.bottomRadixNode(pageIndex)
+	if n == nil {
+		return nil, false
 	}
-	return nil
+	p := n.pages[radixChildIndex(pageIndex, radixLevels-1)]
+	return p, p != nil
 }
 
 func (m *Memory) Invalidate(addr uint64) {
 	// find page, and invalidate addr within it
 	if p, ok := m.pageLookup(addr >> PageAddrSize); ok {
+		p = m.writablePage(addr>>PageAddrSize, p)
 		prevValid := p.Ok[1]
 		p.Invalidate(addr & PageAddrMask)
 		if !prevValid { // if the page was already invalid before, then nodes to mem-root will also still be.
@@ -86,12 +102,13 @@ func (m *Memory) Invalidate(addr uint64) {
 		return
 	}
 
-	// find the gindex of the first page covering the address
-	gindex := (uint64(addr) >> PageAddrSize) | (1 << (64 - PageAddrSize))
-
-	for gindex > 0 {
-		m.nodes[gindex] = nil
-		gindex >>= 1
+	// invalidate the nodes on the path from the page to the root, which the writable page owner also owns
+	pageIndex := addr >> PageAddrSize
+	n := m.radix
+	for level := uint64(0); n != nil; level++ {
+		childIndex := radixChildIndex(pageIndex, level)
+		n.invalidatePath(childIndex)
+		n = n.children[childIndex]
 	}
 }
 
@@ -103,8 +120,11 @@ func (m *Memory) MerkleizeSubtree(gindex uint64) [32]byte {
 	if l > PageKeySize {
 		depthIntoPage := l - 1 - PageKeySize
 		pageIndex := (gindex >> depthIntoPage) & PageKeyMask
-		if p, ok := m.pages[uint64(pageIndex)]; ok {
+		if p, ok := m.page(uint64(pageIndex)); ok {
 			pageGindex := (1 << depthIntoPage) | (gindex & ((1 << depthIntoPage) - 1))
+			if pageGindex < PageSize/32 && !p.Ok[pageGindex] { // merkleization updates the page cache
+				p = m.writablePage(pageIndex, p)
+			}
 			return p.MerkleizeSubtree(pageGindex)
 		} else {
 			return zeroHashes[64-5+1-l] // page does not exist
@@ -113,18 +133,28 @@ func (m *Memory) MerkleizeSubtree(gindex uint64) [32]byte {
 	if l > PageKeySize+1 {
 		panic("cannot jump into intermediate node of page")
 	}
-	n, ok := m.nodes[gindex]
-	if !ok {
+	depth := l - 1
+	n := m.radixNodeAt(depth, gindex)
+	localDepth := depth % radixBits
+	localPath := gindex & ((1 << localDepth) - 1)
+	// the children of the radix node that are within the subtree
+	childCount := uint64(1) << (radixBits - localDepth)
+	childMask := uint16(((1 << childCount) - 1) << (localPath * childCount))
+	if n == nil || n.present&childMask == 0 {
 		// if the node doesn't exist, the whole sub-tree is zeroed
 		return zeroHashes[64-5+1-l]
 	}
-	if n != nil {
-		return *n
+	localGindex := (1 << localDepth) | localPath
+	if n.valid&(1<<localGindex) != 0 {
+		return n.hashes[localGindex]
 	}
 	left := m.MerkleizeSubtree(gindex << 1)
 	right := m.MerkleizeSubtree((gindex << 1) | 1)
 	r := HashPair(left, right)
-	m.nodes[gindex] = &r
+	// merkleization updates the radix node, which may have been copied by the merkleization of its children
+	n = m.writableRadixNodeAt(depth, gindex)
+	n.hashes[localGindex] = r
+	n.valid |= 1 << localGindex
 	return r
 }
 
@@ -161,6 +191,49 @@ func (m *Memory) MerkleRoot() [32]byte {
 	return m.MerkleizeSubtree(1)
 }
 
+// MerkleRootParallel computes the same root as MerkleRoot,
+// but first rehashes the pages that changed since the last merkleization on a pool of workers.
+// The upper levels of the tree, above the pages, are combined sequentially afterwards.
+func (m *Memory) MerkleRootParallel(workers int) [32]byte {
+	if workers > 1 {
+		var dirtyIndices []uint64
+		_ = m.radix.forEachPage(0, 0, func(pageIndex uint64, p *CachedPage) error {
+			if !p.Ok[1] { // page root is invalid if any of the page changed
+				dirtyIndices = append(dirtyIndices, pageIndex)
+			}
+			return nil
+		})
+		dirty := make([]*CachedPage, len(dirtyIndices))
+		for i, pageIndex := range dirtyIndices {
+			p, _ := m.page(pageIndex)
+			dirty[i] = m.writablePage(pageIndex, p)
+		}
+		if len(dirty) > 1 {
+			if workers > len(dirty) {
+				workers = len(dirty)
+			}
+			work := make(chan *CachedPage, workers)
+			var wg sync.WaitGroup
+			wg.Add(workers)
+			for i := 0; i < workers; i++ {
+				go func() {
+					defer wg.Done()
+					for p := range work {
+						// pages are independent, each page only writes to its own cache
+						p.MerkleRoot()
+					}
+				}()
+			}
+			for _, p := range dirty {
+				work <- p
+			}
+			close(work)
+			wg.Wait()
+		}
+	}
+	return m.MerkleRoot()
+}
+
 func (m *Memory) pageLookup(pageIndex uint64) (*CachedPage, bool) {
 	// hit caches
 	if pageIndex == m.lastPageKeys[0] {
@@ -169,7 +242,7 @@ func (m *Memory) pageLookup(pageIndex uint64) (*CachedPage, bool) {
 	if pageIndex == m.lastPageKeys[1] {
 		return m.lastPage[1], true
 	}
-	p, ok := m.pages[pageIndex]
+	p, ok := m.page(pageIndex)
 
 	// only cache existing pages.
 	if ok {
@@ -195,8 +268,10 @@ func (m *Memory) SetUnaligned(addr uint64, dat []byte) {
 		// Go may mmap relatively large ranges, but we only allocate the pages just in time.
 		p = m.AllocPage(pageIndex)
 	} else {
+		p = m.writablePage(pageIndex, p)
 		m.Invalidate(addr) // invalidate this branch of memory, now that the value changed
 	}
+	m.markDirty(pageIndex, p)
 
 	d := copy(p.Data[pageAddr:], dat)
 	if d == len(dat) {
@@ -213,8 +288,10 @@ func (m *Memory) SetUnaligned(addr uint64, dat []byte) {
 		// Go may mmap relatively large ranges, but we only allocate the pages just in time.
 		p = m.AllocPage(pageIndex)
 	} else {
+		p = m.writablePage(pageIndex, p)
 		m.Invalidate(addr) // invalidate this branch of memory, now that the value changed
 	}
+	m.markDirty(pageIndex, p)
 
 	copy(p.Data[pageAddr:], dat)
 }
@@ -260,32 +337,132 @@ func (m *Memory) GetUnaligned(addr uint64, dest []byte) {
 }
 
 func (m *Memory) AllocPage(pageIndex uint64) *CachedPage {
-	p := &CachedPage{Data: new(Page)}
-	m.pages[pageIndex] = p
+	owner := m.writableOwner()
+	p := &CachedPage{Data: new(Page), owner: owner}
 	// make nodes to root
-	k := (1 << PageKeySize) | uint64(pageIndex)
-	for k > 0 {
-		m.nodes[k] = nil
-		k >>= 1
+	n := m.writableRadixNodeAt(0, 1)
+	for level := uint64(0); level < radixLevels; level++ {
+		childIndex := radixChildIndex(pageIndex, level)
+		n.present |= 1 << childIndex
+		n.invalidatePath(childIndex)
+		if level+1 < radixLevels {
+			n = n.writableChild(childIndex, owner)
+		} else {
+			if n.pages[childIndex] == nil {
+				m.pageCount++
+			}
+			n.pages[childIndex] = p
+		}
 	}
+	m.markDirty(pageIndex, p)
 	return p
 }
 
+// writablePage returns the page to modify in-place.
+// If the page is shared with a memory clone, then the page is copied first, and replaces the shared page,
+// along with the shared radix nodes on the path to it.
+func (m *Memory) writablePage(pageIndex uint64, p *CachedPage) *CachedPage {
+	owner := m.writableOwner()
+	if p.owner == owner {
+		return p
+	}
+	out := &CachedPage{Data: new(Page), Cache: p.Cache, Ok: p.Ok, owner: owner}
+	*out.Data = *p.Data
+	n := m.writableRadixNodeAt((radixLevels-1)*radixBits, pageIndex>>radixBits)
+	n.pages[radixChildIndex(pageIndex, radixLevels-1)] = out
+	for i := range m.lastPageKeys {
+		if m.lastPageKeys[i] == pageIndex {
+			m.lastPage[i] = out
+		}
+	}
+	return out
+}
+
+// Clone returns an independent copy of the memory.
+// The radix tree, the pages and the dirty page set are shared copy-on-write: they are only copied
+// when either memory modifies them, and only the radix nodes and pages on the path of a write are copied.
+// Clone does not modify the shared nodes and pages, so a memory can be cloned by multiple goroutines at once,
+// as long as it is not modified meanwhile. A memory and its clones can be used concurrently.
+func (m *Memory) Clone() *Memory {
+	m.owner.frozen.Store(true) // from now on the nodes and pages of the owner are shared
+	return &Memory{
+		radix:        m.radix,
+		owner:        m.owner, // the clone replaces the frozen owner on its first write
+		pageCount:    m.pageCount,
+		lastPageKeys: [2]uint64{^uint64(0), ^uint64(0)},
+		dirty:        m.dirty,
+	}
+}
+
+// markDirty registers the page as dirty. The page must be owned by the writable owner of the memory.
+func (m *Memory) markDirty(pageIndex uint64, p *CachedPage) {
+	if !p.dirty {
+		p.dirty = true
+		m.dirty[pageIndex] = struct{}{}
+	}
+}
+
+// DirtyPages returns the sorted indices of the pages that were allocated or written to since the last ResetDirty.
+func (m *Memory) DirtyPages() []uint64 {
+	out := make([]uint64, 0, len(m.dirty))
+	for pageIndex := range m.dirty {
+		out = append(out, pageIndex)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i] < out[j]
+	})
+	return out
+}
+
+// ResetDirty marks all pages as clean, to track changes from this point onwards.
+func (m *Memory) ResetDirty() {
+	owner := m.writableOwner()
+	for pageIndex := range m.dirty {
+		if p, ok := m.page(pageIndex); ok && p.owner == owner {
+			p.dirty = false
+		}
+	}
+	m.dirty = make(map[uint64]struct{})
+}
+
+// SetPage overwrites the contents of the page at the given page index, allocating it if necessary.
+func (m *Memory) SetPage(pageIndex uint64, data *Page) {
+	p, ok := m.pageLookup(pageIndex)
+	if !ok {
+		p = m.AllocPage(pageIndex)
+	} else {
+		p = m.writablePage(pageIndex, p)
+		m.Invalidate(pageIndex << PageAddrSize)
+	}
+	m.markDirty(pageIndex, p)
+	*p.Data = *data
+	p.InvalidateFull()
+}
+
+// CopyPages returns a new memory with a copy of the given pages. Pages that do not exist are ignored.
+func (m *Memory) CopyPages(pageIndices []uint64) *Memory {
+	out := NewMemory()
+	for _, pageIndex := range pageIndices {
+		if p, ok := m.page(pageIndex); ok {
+			*out.AllocPage(pageIndex).Data = *p.Data
+		}
+	}
+	return out
+}
+
 type pageEntry struct {
 	Index uint64 `json:"index"`
 	Data  *Page  `json:"data"`
 }
 
 func (m *Memory) MarshalJSON() ([]byte, error) {
-	pages := make([]pageEntry, 0, len(m.pages))
-	for k, p := range m.pages {
+	pages := make([]pageEntry, 0, m.pageCount)
+	_ = m.ForEachPage(func(pageIndex uint64, page *Page) error {
 		pages = append(pages, pageEntry{
-			Index: k,
-			Data:  p.Data,
+			Index: pageIndex,
+			Data:  page,
 		})
-	}
-	sort.Slice(pages, func(i, j int) bool {
-		return pages[i].Index < pages[j].Index
+		return nil
 	})
 	return json.Marshal(pages)
 }
@@ -295,12 +472,14 @@ func (m *Memory) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &pages); err != nil {
 		return err
 	}
-	m.nodes = make(map[uint64]*[32]byte)
-	m.pages = make(map[uint64]*CachedPage)
+	m.owner = new(cowOwner)
+	m.radix = &radixNode{owner: m.owner}
+	m.pageCount = 0
+	m.dirty = make(map[uint64]struct{})
 	m.lastPageKeys = [2]uint64{^uint64(0), ^uint64(0)}
 	m.lastPage = [2]*CachedPage{nil, nil}
 	for i, p := range pages {
-		if _, ok := m.pages[p.Index]; ok {
+		if _, ok := m.page(p.Index); ok {
 			return fmt.Errorf("cannot load duplicate page, entry %d, page index %d", i, p.Index)
 		}
 		m.AllocPage(p.Index).Data = p.Data
@@ -315,7 +494,10 @@ func (m *Memory) SetMemoryRange(addr uint64, r io.Reader) error {
 		p, ok := m.pageLookup(pageIndex)
 		if !ok {
 			p = m.AllocPage(pageIndex)
+		} else {
+			p = m.writablePage(pageIndex, p)
 		}
+		m.markDirty(pageIndex, p)
 		p.InvalidateFull()
 		n, err := r.Read(p.Data[pageAddr:])
 		if err != nil {
@@ -366,7 +548,7 @@ func (m *Memory) ReadMemoryRange(addr uint64, count uint64) io.Reader {
 }
 
 func (m *Memory) Usage() string {
-	total := uint64(len(m.pages)) * PageSize
+	total := uint64(m.pageCount) * PageSize
 	const unit = 1024
 	if total < unit {
 		return fmt.Sprintf("%d B", total)
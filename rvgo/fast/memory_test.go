@@ -173,3 +173,212 @@ func TestMemoryJSON(t *testing.T) {
 	m.GetUnaligned(8, dest[:])
 	require.Equal(t, uint8(123), dest[0])
 }
+
+func TestMemoryMerkleRootParallel(t *testing.T) {
+	m := NewMemory()
+	data := make([]byte, PageSize*50)
+	_, err := rand.Read(data[:])
+	require.NoError(t, err)
+	require.NoError(t, m.SetMemoryRange(0x1337_0000, bytes.NewReader(data)))
+	require.NoError(t, m.SetMemoryRange(0xc0_0000_0000, bytes.NewReader(data[:PageSize*3])))
+
+	ref := NewMemory()
+	require.NoError(t, ref.SetMemoryRange(0x1337_0000, bytes.NewReader(data)))
+	require.NoError(t, ref.SetMemoryRange(0xc0_0000_0000, bytes.NewReader(data[:PageSize*3])))
+
+	require.Equal(t, ref.MerkleRoot(), m.MerkleRootParallel(8), "parallel root must match")
+
+	// change a few pages, the other pages stay cached
+	m.SetUnaligned(0x1337_0000+PageSize*7+100, []byte{1, 2, 3})
+	ref.SetUnaligned(0x1337_0000+PageSize*7+100, []byte{1, 2, 3})
+	m.SetUnaligned(0xc0_0000_0000+42, []byte{4})
+	ref.SetUnaligned(0xc0_0000_0000+42, []byte{4})
+	require.Equal(t, ref.MerkleRoot(), m.MerkleRootParallel(3), "parallel root must match after changes")
+	require.Equal(t, ref.MerkleRoot(), m.MerkleRoot(), "sequential root must still match")
+	require.Equal(t, ref.MerkleRoot(), m.MerkleRootParallel(1), "single worker must match")
+}
+
+// naiveMerkleize computes the merkle root of the subtree at the given depth and path,
+// directly from the pages, without any caching.
+func naiveMerkleize(pages map[uint64]*Page, depth uint64, path uint64) [32]byte {
+	if depth == PageKeySize {
+		p, ok := pages[path]
+		if !ok {
+			return zeroHashes[PageAddrSize-5]
+		}
+		return (&CachedPage{Data: p}).MerkleRoot()
+	}
+	shift := PageKeySize - depth
+	empty := true
+	for k := range pages {
+		if k>>shift == path {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		return zeroHashes[64-5-depth]
+	}
+	return HashPair(naiveMerkleize(pages, depth+1, path<<1), naiveMerkleize(pages, depth+1, path<<1|1))
+}
+
+func TestMemoryMerkleizeSubtree(t *testing.T) {
+	m := NewMemory()
+	pages := make(map[uint64]*Page)
+	write := func(addr uint64, v byte) {
+		m.SetUnaligned(addr, []byte{v})
+		pageIndex := addr >> PageAddrSize
+		if _, ok := pages[pageIndex]; !ok {
+			pages[pageIndex] = new(Page)
+		}
+		pages[pageIndex][addr&PageAddrMask] = v
+	}
+	addrs := []uint64{0, 0x1000, 0x2008, 0xF000_0000, 0xF001_0000, 0xc0_0000_1234, 0x7f_0000_0000_0000, 0xFFFF_FFFF_FFFF_FFF0}
+	for i, addr := range addrs {
+		write(addr, byte(i+1))
+	}
+	check := func() {
+		require.Equal(t, naiveMerkleize(pages, 0, 0), m.MerkleRoot(), "root")
+		for _, addr := range addrs {
+			pageIndex := addr >> PageAddrSize
+			for depth := uint64(1); depth < PageKeySize; depth += 5 {
+				path := pageIndex >> (PageKeySize - depth)
+				require.Equal(t, naiveMerkleize(pages, depth, path), m.MerkleizeSubtree((1<<depth)|path),
+					"subtree at depth %d above addr %x", depth, addr)
+			}
+		}
+	}
+	check()
+	write(0x2008, 0xff)
+	write(0xF000_0010, 0xee)
+	write(0x1234_5678_0000, 0xdd) // new page
+	check()
+}
+
+func TestMemoryClone(t *testing.T) {
+	m := NewMemory()
+	m.SetUnaligned(0x1000, []byte{1, 2, 3})
+	m.SetUnaligned(0x8000, []byte{4})
+	m.SetUnaligned(0xc0_0000_0000, []byte{5})
+	_ = m.MerkleRoot()
+	m.SetUnaligned(0x8008, []byte{6}) // leave a dirty page to clone
+
+	c := m.Clone()
+	require.Equal(t, m.MerkleRoot(), c.MerkleRoot(), "clone has same root")
+	require.Equal(t, m.PageCount(), c.PageCount())
+
+	c.SetUnaligned(0x1001, []byte{0xff})
+	c.SetUnaligned(0x2_0000, []byte{0xee}) // new page in clone only
+	m.SetUnaligned(0x8000, []byte{0xdd})
+
+	var tmp [3]byte
+	m.GetUnaligned(0x1000, tmp[:])
+	require.Equal(t, [3]byte{1, 2, 3}, tmp, "original not affected by clone write")
+	c.GetUnaligned(0x1000, tmp[:])
+	require.Equal(t, [3]byte{1, 0xff, 3}, tmp, "clone has its own write")
+	c.GetUnaligned(0x8000, tmp[:1])
+	require.Equal(t, byte(4), tmp[0], "clone not affected by original write")
+	require.Equal(t, 3, m.PageCount())
+	require.Equal(t, 4, c.PageCount())
+
+	// compare against memories that were never cloned
+	expectRoot := func(writes map[uint64]byte) [32]byte {
+		r := NewMemory()
+		for addr, v := range writes {
+			r.SetUnaligned(addr, []byte{v})
+		}
+		return r.MerkleRoot()
+	}
+	require.Equal(t, expectRoot(map[uint64]byte{0x1000: 1, 0x1001: 2, 0x1002: 3, 0x8000: 0xdd, 0x8008: 6, 0xc0_0000_0000: 5}), m.MerkleRoot())
+	require.Equal(t, expectRoot(map[uint64]byte{0x1000: 1, 0x1001: 0xff, 0x1002: 3, 0x8000: 4, 0x8008: 6, 0xc0_0000_0000: 5, 0x2_0000: 0xee}), c.MerkleRoot())
+
+	t.Run("concurrent", func(t *testing.T) {
+		base := NewMemory()
+		data := make([]byte, PageSize*16)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		require.NoError(t, base.SetMemoryRange(0, bytes.NewReader(data)))
+		expected := base.Clone().MerkleRoot()
+		modified := base.Clone()
+		modified.SetUnaligned(100, []byte{0xff})
+		expectedModified := modified.MerkleRoot()
+		// cloning does not modify the memory, so it can be cloned by multiple goroutines at once
+		done := make(chan [2][32]byte)
+		for i := 0; i < 4; i++ {
+			go func() {
+				c := base.Clone()
+				var tmp [8]byte
+				c.GetUnaligned(100, tmp[:])
+				root := c.MerkleRoot()
+				c.SetUnaligned(100, []byte{0xff})
+				done <- [2][32]byte{root, c.MerkleRoot()}
+			}()
+		}
+		for i := 0; i < 4; i++ {
+			require.Equal(t, [2][32]byte{expected, expectedModified}, <-done)
+		}
+		require.Equal(t, expected, base.MerkleRoot())
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		base := NewMemory()
+		base.SetUnaligned(0x1000, []byte{1})
+		base.SetUnaligned(0xc0_0000_0000, []byte{2})
+		_ = base.MerkleRoot()
+		c := base.Clone()
+		require.Same(t, base.radix, c.radix, "clone shares the radix tree")
+		c.SetUnaligned(0x1000, []byte{3})
+		require.NotSame(t, base.radix, c.radix, "write copies the path to the page")
+		basePage, _ := base.page(1)
+		clonePage, _ := c.page(1)
+		require.NotSame(t, basePage, clonePage)
+		basePage, _ = base.page(0xc0_0000_0000 >> PageAddrSize)
+		clonePage, _ = c.page(0xc0_0000_0000 >> PageAddrSize)
+		require.Same(t, basePage, clonePage, "untouched page stays shared")
+		require.Same(t, base.bottomRadixNode(0xc0_0000_0000>>PageAddrSize), c.bottomRadixNode(0xc0_0000_0000>>PageAddrSize),
+			"untouched radix nodes stay shared")
+	})
+}
+
+func TestMemoryDirtyPages(t *testing.T) {
+	m := NewMemory()
+	m.SetUnaligned(0x1000, []byte{1})
+	m.SetUnaligned(0x5000, []byte{2})
+	m.SetUnaligned(0x1008, []byte{3})
+	require.Equal(t, []uint64{1, 5}, m.DirtyPages())
+
+	m.ResetDirty()
+	require.Empty(t, m.DirtyPages())
+	var tmp [1]byte
+	m.GetUnaligned(0x5000, tmp[:])
+	_ = m.MerkleRoot()
+	require.Empty(t, m.DirtyPages(), "reads and merkleization do not make pages dirty")
+
+	m.SetUnaligned(0x5001, []byte{4})
+	require.NoError(t, m.SetMemoryRange(0x3_0000, bytes.NewReader([]byte{5, 6})))
+	require.Equal(t, []uint64{5, 0x30}, m.DirtyPages())
+
+	// clones start with the same dirty pages, and track their own writes
+	c := m.Clone()
+	m.ResetDirty()
+	require.Equal(t, []uint64{5, 0x30}, c.DirtyPages())
+	c.SetUnaligned(0x1000, []byte{7})
+	require.Equal(t, []uint64{1, 5, 0x30}, c.DirtyPages())
+	require.Empty(t, m.DirtyPages())
+	m.SetUnaligned(0x5000, []byte{8})
+	require.Equal(t, []uint64{5}, m.DirtyPages())
+
+	// applying the dirty pages to an older copy reproduces the memory
+	base := NewMemory()
+	base.SetUnaligned(0x1000, []byte{1})
+	base.SetUnaligned(0x5000, []byte{2})
+	base.SetUnaligned(0x1008, []byte{3})
+	_ = base.MerkleRoot()
+	delta := c.CopyPages(c.DirtyPages())
+	require.Equal(t, 3, delta.PageCount())
+	require.NoError(t, delta.ForEachPage(func(pageIndex uint64, page *Page) error {
+		base.SetPage(pageIndex, page)
+		return nil
+	}))
+	require.Equal(t, c.MerkleRoot(), base.MerkleRoot())
+}
@@ -0,0 +1,216 @@
+package fast
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Merkle cache format, following the pages of a state. All integers are big-endian.
+//
+//	root       [32]byte
+//	pageCount  uint64
+//	pages      [pageCount], in ascending page index order, each:
+//	  root     [32]byte
+//	  digest   [32]byte, SHA-256 of the page data
+//	radixNodes pre-order traversal of the radix tree, starting at the root node, each:
+//	  valid    uint16
+//	  hashes   [popcount(valid)][32]byte, in ascending local generalized index order
+//	  children radix nodes of the present children, in ascending child index order, if not in the bottom level
+//
+// The tree shape is not stored: it follows from the pages of the memory the cache is restored into.
+// The page digests bind the cached page roots to the page data, without merkleizing the memory,
+// which takes a keccak256 hash per 32 bytes of memory.
+
+func pageDigest(p *Page) [32]byte {
+	return sha256.Sum256(p[:])
+}
+
+// SerializeMerkleCache writes the memory merkle root, the page roots, and the merkle nodes above the pages,
+// so the merkle root of the memory can be restored without hashing the memory contents.
+// The memory is merkleized first, if it is not already.
+func (m *Memory) SerializeMerkleCache(w io.Writer) error {
+	root := m.MerkleRoot()
+	if _, err := w.Write(root[:]); err != nil {
+		return fmt.Errorf("failed to write merkle root: %w", err)
+	}
+	pageIndices := m.sortedPageIndices()
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], uint64(len(pageIndices)))
+	if _, err := w.Write(tmp[:]); err != nil {
+		return fmt.Errorf("failed to write page count: %w", err)
+	}
+	var entry [32 + 32]byte
+	for _, pageIndex := range pageIndices {
+		p, _ := m.page(pageIndex)
+		digest := pageDigest(p.Data)
+		copy(entry[:32], p.Cache[1][:])
+		copy(entry[32:], digest[:])
+		if _, err := w.Write(entry[:]); err != nil {
+			return fmt.Errorf("failed to write page root %x: %w", pageIndex, err)
+		}
+	}
+	return writeRadixNode(w, m.radix, 0)
+}
+
+func writeRadixNode(w io.Writer, n *radixNode, level uint64) error {
+	out := make([]byte, 2, 2+radixWidth*32)
+	binary.BigEndian.PutUint16(out, n.valid)
+	for k := 1; k < radixWidth; k++ {
+		if n.valid&(1<<k) != 0 {
+			out = append(out, n.hashes[k][:]...)
+		}
+	}
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("failed to write radix node: %w", err)
+	}
+	if level+1 == radixLevels {
+		return nil
+	}
+	for i, c := range n.children {
+		if n.present&(1<<i) != 0 {
+			if err := writeRadixNode(w, c, level+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeserializeMerkleCache restores the merkle cache written by SerializeMerkleCache,
+// into a memory with the same pages, that has not been modified since it was loaded.
+// The page roots are only restored if the digests of the page data match the cache,
+// so a cache of different memory contents is rejected without merkleizing the memory.
+// The restored merkle nodes above the pages are verified against each other and the stored merkle root.
+func (m *Memory) DeserializeMerkleCache(r io.Reader) (err error) {
+	defer func() {
+		if err != nil { // don't leave a partially restored cache behind
+			m.resetMerkleCache()
+		}
+	}()
+	var root [32]byte
+	if _, err := io.ReadFull(r, root[:]); err != nil {
+		return fmt.Errorf("failed to read merkle root: %w", err)
+	}
+	var tmp [8]byte
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		return fmt.Errorf("failed to read page count: %w", err)
+	}
+	pageIndices := m.sortedPageIndices()
+	if n := binary.BigEndian.Uint64(tmp[:]); n != uint64(len(pageIndices)) {
+		return fmt.Errorf("merkle cache has %d pages, but memory has %d pages", n, len(pageIndices))
+	}
+	var entry [32 + 32]byte
+	for _, pageIndex := range pageIndices {
+		if _, err := io.ReadFull(r, entry[:]); err != nil {
+			return fmt.Errorf("failed to read page root %x: %w", pageIndex, err)
+		}
+		p, _ := m.page(pageIndex)
+		if digest := pageDigest(p.Data); !bytes.Equal(entry[32:], digest[:]) {
+			return fmt.Errorf("merkle cache of page %x does not match the page data", pageIndex)
+		}
+		p = m.writablePage(pageIndex, p)
+		copy(p.Cache[1][:], entry[:32])
+		p.Ok[1] = true
+	}
+	if err := readRadixNode(r, m.writableRadixNodeAt(0, 1), 0, m.writableOwner()); err != nil {
+		return err
+	}
+	if err := m.verifyRadixNode(m.radix, 0, 0); err != nil {
+		return err
+	}
+	if got := m.MerkleRoot(); got != root {
+		return fmt.Errorf("restored merkle root %x does not match stored root %x", got, root)
+	}
+	return nil
+}
+
+// readRadixNode reads the hashes of the radix node, and of its children, which are made writable by the given owner.
+// The node itself must be owned by the owner.
+func readRadixNode(r io.Reader, n *radixNode, level uint64, owner *cowOwner) error {
+	var tmp [2]byte
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		return fmt.Errorf("failed to read radix node: %w", err)
+	}
+	n.valid = binary.BigEndian.Uint16(tmp[:])
+	if n.valid&1 != 0 {
+		return errors.New("invalid radix node, local generalized index 0 does not exist")
+	}
+	for k := 1; k < radixWidth; k++ {
+		if n.valid&(1<<k) != 0 {
+			if _, err := io.ReadFull(r, n.hashes[k][:]); err != nil {
+				return fmt.Errorf("failed to read radix node hash: %w", err)
+			}
+		}
+	}
+	if level+1 == radixLevels {
+		return nil
+	}
+	for i := uint64(0); i < radixWidth; i++ {
+		if n.present&(1<<i) != 0 {
+			if err := readRadixNode(r, n.writableChild(i, owner), level+1, owner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyRadixNode checks that the valid hashes of the radix node, at the given radix level and page-index prefix,
+// and its children, match the hash of their child nodes.
+func (m *Memory) verifyRadixNode(n *radixNode, level uint64, prefix uint64) error {
+	for k := uint64(1); k < radixWidth; k++ {
+		if n.valid&(1<<k) == 0 {
+			continue
+		}
+		localDepth := uint64(bits.Len64(k) - 1)
+		depth := level*radixBits + localDepth
+		gindex := (1 << depth) | (prefix << localDepth) | (k & ((1 << localDepth) - 1))
+		if got := HashPair(m.MerkleizeSubtree(gindex<<1), m.MerkleizeSubtree(gindex<<1|1)); got != n.hashes[k] {
+			return fmt.Errorf("merkle cache node %x does not match its children", gindex)
+		}
+	}
+	if level+1 == radixLevels {
+		return nil
+	}
+	for i, c := range n.children {
+		if n.present&(1<<i) != 0 {
+			if err := m.verifyRadixNode(c, level+1, prefix<<radixBits|uint64(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resetMerkleCache invalidates all merkle nodes.
+func (m *Memory) resetMerkleCache() {
+	owner := m.writableOwner()
+	var reset func(n *radixNode)
+	reset = func(n *radixNode) {
+		n.valid = 0
+		for i, c := range n.children {
+			if c != nil {
+				reset(n.writableChild(uint64(i), owner))
+			}
+		}
+	}
+	reset(m.writableRadixNodeAt(0, 1))
+	for _, pageIndex := range m.sortedPageIndices() {
+		p, _ := m.page(pageIndex)
+		m.writablePage(pageIndex, p).Ok = [PageSize / 32]bool{}
+	}
+}
+
+func (m *Memory) sortedPageIndices() []uint64 {
+	out := make([]uint64, 0, m.pageCount)
+	_ = m.radix.forEachPage(0, 0, func(pageIndex uint64, p *CachedPage) error {
+		out = append(out, pageIndex)
+		return nil
+	})
+	return out
+}
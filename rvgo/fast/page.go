@@ -29,6 +29,12 @@ type CachedPage struct {
 	Cache [PageSize / 32][32]byte
 	// true if the intermediate node is valid
 	Ok [PageSize / 32]bool
+	// predecoded instructions, nil if the page was never executed with the decode cache
+	decoded *decodedPage
+	// the owner that may modify the page in-place, see cowOwner
+	owner *cowOwner
+	// true if the page is registered as dirty in the owner memory, see Memory.DirtyPages
+	dirty bool
 }
 
 func (p *CachedPage) Invalidate(pageAddr uint64) {
@@ -42,13 +48,31 @@ func (p *CachedPage) Invalidate(pageAddr uint64) {
 		p.Ok[k] = false
 		k >>= 1
 	}
+	p.invalidateDecoded()
 }
 
 func (p *CachedPage) InvalidateFull() {
 	p.Ok = [PageSize / 32]bool{} // reset everything to false
+	p.invalidateDecoded()
+}
+
+// invalidateDecoded drops any predecoded instructions, the page contents may have changed.
+func (p *CachedPage) invalidateDecoded() {
+	if p.decoded != nil {
+		p.decoded.ok = [PageSize / 4]bool{}
+	}
 }
 
 func (p *CachedPage) MerkleRoot() [32]byte {
+	// the root may be valid without the nodes below it, when restored from a snapshot
+	if !p.Ok[1] {
+		p.fillCache()
+	}
+	return p.Cache[1]
+}
+
+// fillCache computes all merkle nodes of the page that are not valid.
+func (p *CachedPage) fillCache() {
 	// hash the bottom layer
 	for i := uint64(0); i < PageSize; i += 64 {
 		j := PageSize/32/2 + i/64
@@ -69,12 +93,9 @@ func (p *CachedPage) MerkleRoot() [32]byte {
 		p.Cache[j] = HashPair(p.Cache[i], p.Cache[i+1])
 		p.Ok[j] = true
 	}
-
-	return p.Cache[1]
 }
 
 func (p *CachedPage) MerkleizeSubtree(gindex uint64) [32]byte {
-	_ = p.MerkleRoot() // fill cache
 	if gindex >= PageSize/32 {
 		if gindex >= PageSize/32*2 {
 			panic("gindex too deep")
@@ -83,5 +104,8 @@ func (p *CachedPage) MerkleizeSubtree(gindex uint64) [32]byte {
 		nodeIndex := gindex & (PageAddrMask >> 5)
 		return *(*[32]byte)(p.Data[nodeIndex*32 : nodeIndex*32+32])
 	}
+	if !p.Ok[gindex] {
+		p.fillCache()
+	}
 	return p.Cache[gindex]
 }
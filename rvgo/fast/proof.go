@@ -0,0 +1,58 @@
+package fast
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Proof is the data to replicate a step onchain.
+type Proof struct {
+	Step uint64 `json:"step"`
+
+	Pre  common.Hash `json:"pre"`
+	Post common.Hash `json:"post"`
+
+	StateData hexutil.Bytes `json:"state-data"`
+	ProofData hexutil.Bytes `json:"proof-data"`
+
+	OracleKey    hexutil.Bytes `json:"oracle-key,omitempty"`
+	OracleValue  hexutil.Bytes `json:"oracle-value,omitempty"`
+	OracleOffset uint64        `json:"oracle-offset,omitempty"`
+}
+
+// StepFn executes the next step, with proof generation if proof is true, like InstrumentedState.Step.
+type StepFn func(proof bool) (*StepWitness, error)
+
+// ProveStep executes the next step of the state with proof generation, and returns the proof of the step.
+// The pre-state is merkleized with the given number of parallel workers.
+func ProveStep(state *VMState, stepFn StepFn, workers int) (*Proof, error) {
+	step := state.Step
+	// many pages may have changed since the last proof, merkleize them in parallel
+	preStateHash, err := state.EncodeWitnessParallel(workers).StateHash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash prestate witness: %w", err)
+	}
+	witness, err := stepFn(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed at proof-gen step %d (PC: %08x): %w", step, state.PC, err)
+	}
+	postStateHash, err := state.EncodeWitness().StateHash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash poststate witness: %w", err)
+	}
+	proof := &Proof{
+		Step:      step,
+		Pre:       preStateHash,
+		Post:      postStateHash,
+		StateData: witness.State,
+		ProofData: witness.MemProof,
+	}
+	if witness.HasPreimage() {
+		proof.OracleKey = witness.PreimageKey[:]
+		proof.OracleValue = witness.PreimageValue
+		proof.OracleOffset = witness.PreimageOffset
+	}
+	return proof, nil
+}
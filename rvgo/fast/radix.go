@@ -0,0 +1,138 @@
+package fast
+
+import "sync/atomic"
+
+// The merkle-tree nodes above the pages are stored in a radix tree, aligned with the page keys.
+// Each radix node covers radixBits levels of the binary merkle tree,
+// and caches the hashes of the binary nodes within it in a flat array, indexed by local generalized index.
+// Radix nodes only exist for ranges of memory that contain pages.
+const (
+	radixBits   = 4
+	radixWidth  = 1 << radixBits
+	radixLevels = PageKeySize / radixBits
+)
+
+type radixNode struct {
+	// local generalized index (1 ... radixWidth-1) -> cached merkle node
+	hashes [radixWidth][32]byte
+	// bitfield of local generalized indices with a valid cached hash
+	valid uint16
+	// bitfield of child indices with at least one page
+	present uint16
+	// child radix nodes, always nil in the bottom radix level: the children of those are pages
+	children [radixWidth]*radixNode
+	// pages of the bottom radix level, always nil in the other levels
+	pages [radixWidth]*CachedPage
+	// the owner that may modify the node in-place, see cowOwner
+	owner *cowOwner
+}
+
+// cowOwner is the owner of the radix nodes and pages that a memory may modify in-place.
+// Cloning a memory freezes its owner: the nodes and pages of a frozen owner are shared with the clone,
+// and are copied by either memory before modifying them.
+// Nodes are copied from the root down, so the ancestors of an owned node or page are owned too.
+type cowOwner struct {
+	frozen atomic.Bool
+}
+
+// radixChildIndex returns the index of the child within the radix node at the given radix level,
+// on the path to the given page.
+func radixChildIndex(pageIndex uint64, level uint64) uint64 {
+	return (pageIndex >> (PageKeySize - radixBits*(level+1))) & (radixWidth - 1)
+}
+
+// invalidatePath clears the cached hashes in the radix node, on the path to the given child.
+func (n *radixNode) invalidatePath(childIndex uint64) {
+	k := (radixWidth | childIndex) >> 1
+	for k > 0 {
+		n.valid &^= 1 << k
+		k >>= 1
+	}
+}
+
+// radixNodeAt finds the radix node that contains the binary merkle node at the given depth (0 = root) and path,
+// or nil if no such node exists, i.e. the subtree is empty.
+func (m *Memory) radixNodeAt(depth uint64, path uint64) *radixNode {
+	n := m.radix
+	for level := uint64(0); level < depth/radixBits; level++ {
+		n = n.children[(path>>(depth-radixBits*(level+1)))&(radixWidth-1)]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// writableChild returns the child radix node to modify in-place, creating it if it does not exist.
+// The node itself must be owned by the given owner.
+func (n *radixNode) writableChild(childIndex uint64, owner *cowOwner) *radixNode {
+	c := n.children[childIndex]
+	if c == nil {
+		c = &radixNode{owner: owner}
+	} else if c.owner != owner {
+		cp := *c
+		cp.owner = owner
+		c = &cp
+	} else {
+		return c
+	}
+	n.children[childIndex] = c
+	return c
+}
+
+// writableOwner returns the owner of the nodes and pages that the memory may modify in-place.
+// If the owner is frozen by a clone, the memory continues with a new owner, which owns nothing yet,
+// and with a copy of the dirty page set, which is shared with the clone too.
+func (m *Memory) writableOwner() *cowOwner {
+	if m.owner.frozen.Load() {
+		m.owner = new(cowOwner)
+		dirty := make(map[uint64]struct{}, len(m.dirty))
+		for pageIndex := range m.dirty {
+			dirty[pageIndex] = struct{}{}
+		}
+		m.dirty = dirty
+	}
+	return m.owner
+}
+
+// writableRadixNodeAt returns the radix node to modify in-place, at the given depth and path, see radixNodeAt.
+// The nodes on the path are copied if they are shared, and created if they do not exist.
+func (m *Memory) writableRadixNodeAt(depth uint64, path uint64) *radixNode {
+	owner := m.writableOwner()
+	if m.radix.owner != owner {
+		cp := *m.radix
+		cp.owner = owner
+		m.radix = &cp
+	}
+	n := m.radix
+	for level := uint64(0); level < depth/radixBits; level++ {
+		n = n.writableChild((path>>(depth-radixBits*(level+1)))&(radixWidth-1), owner)
+	}
+	return n
+}
+
+// bottomRadixNode returns the radix node of the bottom level that holds the given page, or nil if it does not exist.
+func (m *Memory) bottomRadixNode(pageIndex uint64) *radixNode {
+	n := m.radix
+	for level := uint64(0); level+1 < radixLevels && n != nil; level++ {
+		n = n.children[radixChildIndex(pageIndex, level)]
+	}
+	return n
+}
+
+// forEachPage calls fn with the pages of the radix node and its children, in ascending page index order.
+func (n *radixNode) forEachPage(level uint64, prefix uint64, fn func(pageIndex uint64, p *CachedPage) error) error {
+	for i := uint64(0); i < radixWidth; i++ {
+		if n.present&(1<<i) == 0 {
+			continue
+		}
+		if level+1 == radixLevels {
+			if err := fn(prefix<<radixBits|i, n.pages[i]); err != nil {
+				return err
+			}
+		} else if err := n.children[i].forEachPage(level+1, prefix<<radixBits|i, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
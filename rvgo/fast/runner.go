@@ -0,0 +1,328 @@
+package fast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	preimage "github.com/ethereum-optimism/optimism/op-preimage"
+)
+
+// StepMatcher matches the state before a step, to act on the step.
+type StepMatcher func(state *VMState) bool
+
+// PreimageMatcher matches a pre-image that was read by a step, by its key and value, without the length prefix.
+type PreimageMatcher func(key [32]byte, value []byte) bool
+
+// PreimageStopMatcher returns the matcher of the pre-images to stop a run at:
+// those of the key type, one of "local", "keccak", "sha256", "blob", or "any" for all key types,
+// and those larger than largerThan bytes, including their 8-byte length prefix, if largerThan is not 0.
+// It returns nil if the key type is empty and largerThan is 0, as the matcher would never match.
+func PreimageStopMatcher(keyType string, largerThan int) (PreimageMatcher, error) {
+	anyType := false
+	var typeByte preimage.KeyType
+	switch keyType {
+	case "local":
+		typeByte = preimage.LocalKeyType
+	case "keccak":
+		typeByte = preimage.Keccak256KeyType
+	case "sha256":
+		typeByte = preimage.Sha256KeyType
+	case "blob":
+		typeByte = preimage.BlobKeyType
+	case "any":
+		anyType = true
+	case "":
+		// 0 preimage type is forbidden so will not stop at any preimage
+	default:
+		return nil, fmt.Errorf("invalid preimage type %q", keyType)
+	}
+	if !anyType && typeByte == 0 && largerThan == 0 {
+		return nil, nil
+	}
+	return func(key [32]byte, value []byte) bool {
+		return anyType || key[0] == byte(typeByte) || (largerThan != 0 && 8+len(value) > largerThan)
+	}, nil
+}
+
+// StopReason is the reason that a run stopped.
+type StopReason uint8
+
+const (
+	// StopExited is a run that stopped because the program exited.
+	StopExited StopReason = iota
+	// StopMatched is a run that stopped before a step, by RunOptions.StopAt.
+	StopMatched
+	// StopAfterStep is a run that stopped after a step, by RunOptions.StopAfter.
+	StopAfterStep
+	// StopPreimage is a run that stopped after a step that read pre-image data, by RunOptions.StopAtPreimage.
+	StopPreimage
+	// StopMaxSteps is a run that stopped after RunOptions.MaxSteps steps.
+	StopMaxSteps
+	// StopMaxDuration is a run that stopped after RunOptions.MaxDuration.
+	StopMaxDuration
+	// StopInterrupted is a run that stopped because its context was canceled.
+	StopInterrupted
+	// StopFailed is a run that stopped because a step or a callback failed.
+	StopFailed
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopExited:
+		return "exited"
+	case StopMatched:
+		return "matched"
+	case StopAfterStep:
+		return "after-step"
+	case StopPreimage:
+		return "preimage"
+	case StopMaxSteps:
+		return "max-steps"
+	case StopMaxDuration:
+		return "max-duration"
+	case StopInterrupted:
+		return "interrupted"
+	case StopFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("stop-reason-%d", uint8(r))
+	}
+}
+
+// RunOptions configure the steps that a Runner acts on, and when it stops.
+// Nil matchers never match, and nil callbacks are not called.
+// A callback error stops the run, and is returned by Runner.Run.
+type RunOptions struct {
+	// StopAt stops the run before the matching step. It is checked before every step.
+	StopAt StepMatcher
+	// StopAfter stops the run after a step, if it matches the state after the step.
+	StopAfter StepMatcher
+	// StopAtPreimage stops the run after a step that read pre-image data, if it matches the pre-image.
+	StopAtPreimage PreimageMatcher
+	// MaxSteps is the maximum number of steps to run, 0 for no limit.
+	MaxSteps uint64
+	// MaxDuration is the maximum wall-clock duration of the run, 0 for no limit.
+	// It is checked every 100 steps, like the cancellation of the context.
+	MaxDuration time.Duration
+
+	// ProofAt generates a proof of the matching steps, that is passed to OnProof.
+	ProofAt StepMatcher
+	// ProofWorkers is the number of workers to merkleize the pre-state of proofs with. Defaults to the number of CPUs.
+	ProofWorkers int
+	// SnapshotAt passes the state before the matching steps to OnSnapshot.
+	SnapshotAt StepMatcher
+	// HashAt passes the state hash before the matching steps, and of the final state if it matches, to OnHash.
+	HashAt StepMatcher
+
+	// StepFn executes the steps, to wrap the errors of InstrumentedState.Step. Defaults to InstrumentedState.Step.
+	StepFn StepFn
+
+	// OnStep is called before every step, after the stop conditions are checked and the snapshot is taken.
+	OnStep func(state *VMState) error
+	// OnSnapshot is called with the state before the steps of SnapshotAt.
+	OnSnapshot func(state *VMState) error
+	// OnProof is called with the proofs of the steps of ProofAt.
+	OnProof func(proof *Proof) error
+	// OnHash is called with the state hashes of HashAt.
+	OnHash func(step uint64, hash common.Hash) error
+	// OnPreimage is called after every step that read pre-image data, with the pre-image key and value.
+	// The value is only valid during the call, it is reused by later steps: copy it to retain it.
+	OnPreimage func(key [32]byte, value []byte) error
+}
+
+// Runner runs an instrumented state, acting on the steps as configured by its options.
+// It is the run loop of the run command, to embed in other programs.
+type Runner struct {
+	us   *InstrumentedState
+	opts RunOptions
+
+	// fast is true if the run has no callbacks after each step, so it can run with InstrumentedState.RunUntil
+	fast bool
+
+	start     time.Time
+	startStep uint64
+}
+
+func NewRunner(us *InstrumentedState, opts RunOptions) *Runner {
+	fast := opts.StepFn == nil && opts.StopAfter == nil && opts.StopAtPreimage == nil && opts.OnPreimage == nil
+	if opts.StepFn == nil {
+		opts.StepFn = us.Step
+	}
+	if opts.ProofWorkers < 1 {
+		opts.ProofWorkers = runtime.NumCPU()
+	}
+	return &Runner{us: us, opts: opts, fast: fast}
+}
+
+// stepAction is what a runner does after checking the state before a step.
+type stepAction uint8
+
+const (
+	actionStep stepAction = iota
+	actionProve
+	actionStop
+)
+
+// Run runs steps until the program exits, or one of the stop conditions of the options is met,
+// and returns the reason that it stopped. If the context is canceled, the current step is completed,
+// and the run stops with StopInterrupted and the context error.
+//
+// Without StepFn and the callbacks after each step (StopAfter, StopAtPreimage and OnPreimage),
+// and with the decode cache enabled, the steps run with InstrumentedState.RunUntil,
+// without the per-step setup of InstrumentedState.Step.
+func (r *Runner) Run(ctx context.Context) (StopReason, error) {
+	state := r.us.state
+	r.start = time.Now()
+	r.startStep = state.Step
+	run := r.runSteps
+	if r.fast && r.us.decodeCache {
+		run = r.runUntil
+	}
+	reason, err := run(ctx)
+	if reason == StopFailed {
+		return reason, err
+	}
+	// the final state is not checked before a step
+	if r.opts.HashAt != nil && r.opts.OnHash != nil && r.opts.HashAt(state) {
+		if err := r.hash(state); err != nil {
+			return StopFailed, err
+		}
+	}
+	return reason, err
+}
+
+// before checks the stop conditions of the state before a step, and calls the callbacks of the step.
+// It returns the reason and error to stop with, if the action is actionStop.
+func (r *Runner) before(ctx context.Context, state *VMState) (stepAction, StopReason, error) {
+	opts := &r.opts
+	if state.Step%100 == 0 { // don't do the ctx err check (includes lock) too often
+		if err := ctx.Err(); err != nil {
+			return actionStop, StopInterrupted, err
+		}
+		if opts.MaxDuration != 0 && time.Since(r.start) >= opts.MaxDuration {
+			return actionStop, StopMaxDuration, nil
+		}
+	}
+	if opts.MaxSteps != 0 && state.Step-r.startStep >= opts.MaxSteps {
+		return actionStop, StopMaxSteps, nil
+	}
+	if opts.StopAt != nil && opts.StopAt(state) {
+		return actionStop, StopMatched, nil
+	}
+
+	if opts.SnapshotAt != nil && opts.OnSnapshot != nil && opts.SnapshotAt(state) {
+		if err := opts.OnSnapshot(state); err != nil {
+			return actionStop, StopFailed, err
+		}
+	}
+	if opts.HashAt != nil && opts.OnHash != nil && opts.HashAt(state) {
+		if err := r.hash(state); err != nil {
+			return actionStop, StopFailed, err
+		}
+	}
+	if opts.OnStep != nil {
+		if err := opts.OnStep(state); err != nil {
+			return actionStop, StopFailed, err
+		}
+	}
+	if opts.ProofAt != nil && opts.ProofAt(state) {
+		return actionProve, 0, nil
+	}
+	return actionStep, 0, nil
+}
+
+func (r *Runner) hash(state *VMState) error {
+	// many pages may have changed since the last hash, merkleize them in parallel
+	h, err := state.EncodeWitnessParallel(r.opts.ProofWorkers).StateHash()
+	if err != nil {
+		return fmt.Errorf("failed to hash state: %w", err)
+	}
+	return r.opts.OnHash(state.Step, h)
+}
+
+func (r *Runner) prove(state *VMState) error {
+	proof, err := ProveStep(state, r.opts.StepFn, r.opts.ProofWorkers)
+	if err != nil {
+		return err
+	}
+	if r.opts.OnProof != nil {
+		return r.opts.OnProof(proof)
+	}
+	return nil
+}
+
+// runUntil runs the steps with InstrumentedState.RunUntil, which only returns to generate proofs.
+func (r *Runner) runUntil(ctx context.Context) (StopReason, error) {
+	state := r.us.state
+	for !state.Exited {
+		action := actionStep
+		var reason StopReason
+		var stopErr error
+		err := r.us.RunUntil(ctx, func(state *VMState) bool {
+			if state.Exited { // the final state is not before a step
+				return true
+			}
+			action, reason, stopErr = r.before(ctx, state)
+			return action != actionStep
+		})
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+				return StopInterrupted, err
+			}
+			return StopFailed, fmt.Errorf("failed at step %d (PC: %08x): %w", state.Step, state.PC, err)
+		}
+		switch action {
+		case actionStop:
+			return reason, stopErr
+		case actionProve:
+			if err := r.prove(state); err != nil {
+				return StopFailed, err
+			}
+		}
+	}
+	return StopExited, nil
+}
+
+// runSteps runs the steps one by one with RunOptions.StepFn, to act on the state after each step.
+func (r *Runner) runSteps(ctx context.Context) (StopReason, error) {
+	state := r.us.state
+	opts := &r.opts
+	for !state.Exited {
+		action, reason, err := r.before(ctx, state)
+		if action == actionStop {
+			return reason, err
+		}
+
+		step := state.Step
+		prevPreimageOffset := state.PreimageOffset
+		if action == actionProve {
+			if err := r.prove(state); err != nil {
+				return StopFailed, err
+			}
+		} else if _, err := opts.StepFn(false); err != nil {
+			return StopFailed, fmt.Errorf("failed at step %d (PC: %08x): %w", step, state.PC, err)
+		}
+
+		if opts.StopAfter != nil && opts.StopAfter(state) {
+			return StopAfterStep, nil
+		}
+		if preimageRead := state.PreimageOffset > prevPreimageOffset; preimageRead && (opts.OnPreimage != nil || opts.StopAtPreimage != nil) {
+			key := state.PreimageKey
+			value := r.us.lastPreimage[8:] // without the length prefix, reused by later steps
+			if opts.OnPreimage != nil {
+				if err := opts.OnPreimage(key, value); err != nil {
+					return StopFailed, err
+				}
+			}
+			if opts.StopAtPreimage != nil && opts.StopAtPreimage(key, value) {
+				return StopPreimage, nil
+			}
+		}
+	}
+	return StopExited, nil
+}
@@ -0,0 +1,235 @@
+package fast
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+type staticOracle []byte
+
+func (o staticOracle) Hint(v []byte) {}
+
+func (o staticOracle) GetPreimage(k [32]byte) []byte {
+	return o
+}
+
+func TestRunner(t *testing.T) {
+	// a program that writes a pre-image key, reads the pre-image length prefix, and exits
+	program := []uint32{
+		6<<20 | 10<<7 | 0x13,  // addi a0, zero, 6
+		2<<12 | 11<<7 | 0x37,  // lui a1, 2
+		32<<20 | 12<<7 | 0x13, // addi a2, zero, 32
+		64<<20 | 17<<7 | 0x13, // addi a7, zero, 64
+		0x73,                  // ecall
+		5<<20 | 10<<7 | 0x13,  // addi a0, zero, 5
+		3<<12 | 11<<7 | 0x37,  // lui a1, 3
+		8<<20 | 12<<7 | 0x13,  // addi a2, zero, 8
+		63<<20 | 17<<7 | 0x13, // addi a7, zero, 63
+		0x73,                  // ecall
+		93<<20 | 17<<7 | 0x13, // addi a7, zero, 93
+		0x73,                  // ecall
+	}
+	key := [32]byte{0: 2, 31: 1}
+	newState := func() *VMState {
+		s := newTestState(program)
+		s.Memory.SetUnaligned(0x2000, key[:])
+		return s
+	}
+	oracle := staticOracle("hello")
+	run := func(opts RunOptions) (*VMState, StopReason, error) {
+		state := newState()
+		us := NewInstrumentedState(state, oracle, nil, nil)
+		reason, err := NewRunner(us, opts).Run(context.Background())
+		return state, reason, err
+	}
+
+	t.Run("callbacks", func(t *testing.T) {
+		var steps, snapshots []uint64
+		var proofs []*Proof
+		var preimages [][]byte
+		state, reason, err := run(RunOptions{
+			ProofAt: func(state *VMState) bool {
+				return state.Step == 5
+			},
+			SnapshotAt: func(state *VMState) bool {
+				return state.Step%4 == 0
+			},
+			OnStep: func(state *VMState) error {
+				steps = append(steps, state.Step)
+				return nil
+			},
+			OnSnapshot: func(state *VMState) error {
+				snapshots = append(snapshots, state.Step)
+				return nil
+			},
+			OnProof: func(proof *Proof) error {
+				proofs = append(proofs, proof)
+				return nil
+			},
+			OnPreimage: func(k [32]byte, value []byte) error {
+				require.Equal(t, key, k)
+				preimages = append(preimages, append([]byte(nil), value...))
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, StopExited, reason)
+		require.True(t, state.Exited)
+		require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, steps)
+		require.Equal(t, []uint64{0, 4, 8}, snapshots)
+		require.Equal(t, [][]byte{[]byte("hello")}, preimages)
+
+		require.Len(t, proofs, 1)
+		require.Equal(t, uint64(5), proofs[0].Step)
+		pre, _, err := run(RunOptions{StopAt: func(state *VMState) bool {
+			return state.Step == 5
+		}})
+		require.NoError(t, err)
+		preHash, err := pre.EncodeWitness().StateHash()
+		require.NoError(t, err)
+		require.Equal(t, preHash, proofs[0].Pre)
+	})
+
+	t.Run("fast path", func(t *testing.T) {
+		// the callbacks before a step are the same with and without a step function, that disables the fast path
+		for _, withStepFn := range []bool{false, true} {
+			var steps, snapshots, hashSteps []uint64
+			var hashes []common.Hash
+			var proofs []*Proof
+			state := newState()
+			us := NewInstrumentedState(state, oracle, nil, nil)
+			us.SetDecodeCache(true)
+			opts := RunOptions{
+				ProofAt: func(state *VMState) bool {
+					return state.Step == 5
+				},
+				SnapshotAt: func(state *VMState) bool {
+					return state.Step%4 == 0
+				},
+				HashAt: func(state *VMState) bool {
+					return state.Step%5 == 0 || state.Exited
+				},
+				OnStep: func(state *VMState) error {
+					steps = append(steps, state.Step)
+					return nil
+				},
+				OnSnapshot: func(state *VMState) error {
+					snapshots = append(snapshots, state.Step)
+					return nil
+				},
+				OnProof: func(proof *Proof) error {
+					proofs = append(proofs, proof)
+					return nil
+				},
+				OnHash: func(step uint64, hash common.Hash) error {
+					hashSteps = append(hashSteps, step)
+					hashes = append(hashes, hash)
+					return nil
+				},
+			}
+			if withStepFn {
+				opts.StepFn = us.Step
+			}
+			runner := NewRunner(us, opts)
+			require.Equal(t, !withStepFn, runner.fast)
+			reason, err := runner.Run(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, StopExited, reason)
+			require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, steps)
+			require.Equal(t, []uint64{0, 4, 8}, snapshots)
+			require.Equal(t, []uint64{0, 5, 10, 12}, hashSteps, "includes the final state")
+			finalHash, err := state.EncodeWitness().StateHash()
+			require.NoError(t, err)
+			require.Equal(t, finalHash, hashes[3])
+			require.Len(t, proofs, 1)
+			require.Equal(t, uint64(5), proofs[0].Step)
+			require.Equal(t, hashes[1], proofs[0].Pre)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		state, reason, err := run(RunOptions{StopAt: func(state *VMState) bool {
+			return state.Step == 3
+		}})
+		require.NoError(t, err)
+		require.Equal(t, StopMatched, reason)
+		require.Equal(t, uint64(3), state.Step)
+
+		state, reason, err = run(RunOptions{StopAfter: func(state *VMState) bool {
+			return state.Step == 3
+		}})
+		require.NoError(t, err)
+		require.Equal(t, StopAfterStep, reason)
+		require.Equal(t, uint64(3), state.Step)
+
+		state, reason, err = run(RunOptions{MaxSteps: 7})
+		require.NoError(t, err)
+		require.Equal(t, StopMaxSteps, reason)
+		require.Equal(t, uint64(7), state.Step)
+
+		state, reason, err = run(RunOptions{StopAtPreimage: func(key [32]byte, value []byte) bool {
+			return len(value) == 5
+		}})
+		require.NoError(t, err)
+		require.Equal(t, StopPreimage, reason)
+		require.Equal(t, uint64(10), state.Step, "stops after the step that read the pre-image")
+
+		stopAtKeccak, err := PreimageStopMatcher("keccak", 0)
+		require.NoError(t, err)
+		state, reason, err = run(RunOptions{StopAtPreimage: stopAtKeccak})
+		require.NoError(t, err)
+		require.Equal(t, StopPreimage, reason)
+		require.Equal(t, uint64(10), state.Step)
+	})
+
+	t.Run("preimage matcher", func(t *testing.T) {
+		local := [32]byte{0: 1}
+		keccak := [32]byte{0: 2}
+		m, err := PreimageStopMatcher("", 0)
+		require.NoError(t, err)
+		require.Nil(t, m, "never matches")
+
+		m, err = PreimageStopMatcher("local", 0)
+		require.NoError(t, err)
+		require.True(t, m(local, nil))
+		require.False(t, m(keccak, nil))
+
+		m, err = PreimageStopMatcher("any", 0)
+		require.NoError(t, err)
+		require.True(t, m(local, nil))
+		require.True(t, m(keccak, nil))
+
+		m, err = PreimageStopMatcher("", 10)
+		require.NoError(t, err)
+		require.False(t, m(keccak, []byte("hi")))
+		require.True(t, m(keccak, []byte("hi there")), "the size includes the length prefix")
+
+		_, err = PreimageStopMatcher("unknown", 0)
+		require.ErrorContains(t, err, "invalid preimage type")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		errStep := errors.New("step error")
+		state, reason, err := run(RunOptions{OnStep: func(state *VMState) error {
+			if state.Step == 2 {
+				return errStep
+			}
+			return nil
+		}})
+		require.ErrorIs(t, err, errStep)
+		require.Equal(t, StopFailed, reason)
+		require.Equal(t, uint64(2), state.Step)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		state = newState()
+		reason, err = NewRunner(NewInstrumentedState(state, oracle, nil, nil), RunOptions{}).Run(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, StopInterrupted, reason)
+		require.Equal(t, uint64(0), state.Step)
+	})
+}
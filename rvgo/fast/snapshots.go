@@ -0,0 +1,45 @@
+package fast
+
+// SnapshotWriter writes the snapshots of a run, as full states, or as deltas of the last full snapshot.
+// Its Snapshot method is the RunOptions.OnSnapshot callback.
+// The encoding of the states is up to the write functions, the writer only decides what to write where.
+type SnapshotWriter struct {
+	// Path returns the path to write the snapshot of the step to.
+	Path func(step uint64) string
+	// WriteFull writes the full state to the path.
+	WriteFull func(path string, state *VMState) error
+	// WriteDelta, if not nil, writes snapshots as deltas of the full snapshot at basePath,
+	// with only the memory pages that changed since, as tracked by the memory dirty pages.
+	// The first snapshot, and those matched by FullAt, are full snapshots.
+	WriteDelta func(path string, state *VMState, basePath string) error
+	// FullAt matches the states to write a full snapshot of, instead of a delta. Nil never matches.
+	FullAt StepMatcher
+	// OnWritten, if not nil, is called after the snapshot of a step is written, e.g. to add it to a snapshot store.
+	OnWritten func(step uint64) error
+
+	// base is the path of the last full snapshot, that delta snapshots refer to
+	base string
+}
+
+// Snapshot writes the snapshot of the state.
+func (w *SnapshotWriter) Snapshot(state *VMState) error {
+	path := w.Path(state.Step)
+	if w.WriteDelta != nil && w.base != "" && (w.FullAt == nil || !w.FullAt(state)) {
+		if err := w.WriteDelta(path, state, w.base); err != nil {
+			return err
+		}
+	} else {
+		if err := w.WriteFull(path, state); err != nil {
+			return err
+		}
+		if w.WriteDelta != nil {
+			// following delta snapshots only include the pages that change after this snapshot
+			state.Memory.ResetDirty()
+			w.base = path
+		}
+	}
+	if w.OnWritten != nil {
+		return w.OnWritten(state.Step)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package fast
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotWriter(t *testing.T) {
+	var written []string
+	var deltaPages []int
+	var added []uint64
+	w := &SnapshotWriter{
+		Path: func(step uint64) string {
+			return fmt.Sprintf("state-%d", step)
+		},
+		WriteFull: func(path string, state *VMState) error {
+			written = append(written, path)
+			return nil
+		},
+		WriteDelta: func(path string, state *VMState, basePath string) error {
+			written = append(written, path+" of "+basePath)
+			deltaPages = append(deltaPages, len(state.Memory.DirtyPages()))
+			return nil
+		},
+		FullAt: func(state *VMState) bool {
+			return state.Step == 20
+		},
+		OnWritten: func(step uint64) error {
+			added = append(added, step)
+			return nil
+		},
+	}
+	state := NewVMState()
+	state.Memory.SetUnaligned(0x1000, []byte{1})
+	for _, step := range []uint64{0, 10, 20, 30} {
+		state.Step = step
+		state.Memory.SetUnaligned(0x10000*(step+1), []byte{1})
+		require.NoError(t, w.Snapshot(state))
+	}
+	require.Equal(t, []string{"state-0", "state-10 of state-0", "state-20", "state-30 of state-20"}, written)
+	require.Equal(t, []int{1, 1}, deltaPages, "deltas only include the pages changed since the full snapshot")
+	require.Equal(t, []uint64{0, 10, 20, 30}, added)
+
+	// without WriteDelta all snapshots are full
+	written = nil
+	w.WriteDelta = nil
+	require.NoError(t, w.Snapshot(state))
+	require.Equal(t, []string{"state-30"}, written)
+}
@@ -60,9 +60,29 @@ func NewVMState() *VMState {
 
 func (state *VMState) GetStep() uint64 { return state.Step }
 
+// Clone returns an independent copy of the state.
+// The memory is copied copy-on-write, see Memory.Clone.
+func (state *VMState) Clone() *VMState {
+	out := *state
+	out.Memory = state.Memory.Clone()
+	if state.LastHint != nil {
+		out.LastHint = append(hexutil.Bytes{}, state.LastHint...)
+	}
+	return &out
+}
+
 func (state *VMState) EncodeWitness() StateWitness {
+	return state.encodeWitness(state.Memory.MerkleRoot())
+}
+
+// EncodeWitnessParallel encodes the same witness as EncodeWitness,
+// but merkleizes the memory with the given number of workers. See Memory.MerkleRootParallel.
+func (state *VMState) EncodeWitnessParallel(workers int) StateWitness {
+	return state.encodeWitness(state.Memory.MerkleRootParallel(workers))
+}
+
+func (state *VMState) encodeWitness(memRoot [32]byte) StateWitness {
 	out := make([]byte, 0)
-	memRoot := state.Memory.MerkleRoot()
 	out = append(out, memRoot[:]...)
 	out = append(out, state.PreimageKey[:]...)
 	out = binary.BigEndian.AppendUint64(out, state.PreimageOffset)
@@ -111,6 +131,11 @@ func (sw StateWitness) StateHash() (common.Hash, error) {
 	return hash, nil
 }
 
+// VMStatus returns the status of the VM, as committed to in the first byte of the state hash.
+func (state *VMState) VMStatus() uint8 {
+	return vmStatus(state.Exited, state.ExitCode)
+}
+
 func vmStatus(exited bool, exitCode uint8) uint8 {
 	if !exited {
 		return VMStatusUnfinished
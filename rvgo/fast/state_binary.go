@@ -0,0 +1,214 @@
+package fast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary state format. All integers are big-endian.
+//
+//	magic           [8]byte   "asterisc"
+//	version         uint32
+//	preimageKey     [32]byte
+//	preimageOffset  uint64
+//	pc              uint64
+//	exitCode        uint8
+//	exited          uint8
+//	step            uint64
+//	heap            uint64
+//	loadReservation uint64
+//	registers       [32]uint64
+//	lastHintLen     uint32
+//	lastHint        [lastHintLen]byte
+//	pageCount       uint64
+//	pageIndices     [pageCount]uint64, strictly ascending
+//	pages           [pageCount][PageSize]byte, in the order of pageIndices
+//	hasMerkleCache  uint8, since version 2
+//	merkleCache     see Memory.SerializeMerkleCache, if hasMerkleCache is 1
+//
+// The page table comes before the page contents, so the memory layout can be inspected without reading all data.
+const (
+	StateBinaryMagic   = "asterisc"
+	StateBinaryVersion = uint32(2)
+
+	stateBinaryScalarsSize = 8 + 4 + 32 + 8 + 8 + 1 + 1 + 8 + 8 + 8 + 32*8
+)
+
+// Serialize writes the state in the binary state format.
+func (state *VMState) Serialize(w io.Writer) error {
+	return state.serialize(w, false)
+}
+
+// SerializeWithMerkleCache writes the state in the binary state format, including the memory merkle cache,
+// so the state can be hashed right after loading it, without rehashing all memory.
+func (state *VMState) SerializeWithMerkleCache(w io.Writer) error {
+	return state.serialize(w, true)
+}
+
+func (state *VMState) serialize(w io.Writer, withMerkleCache bool) error {
+	var buf [stateBinaryScalarsSize]byte
+	out := buf[:0]
+	out = append(out, StateBinaryMagic...)
+	out = binary.BigEndian.AppendUint32(out, StateBinaryVersion)
+	out = append(out, state.PreimageKey[:]...)
+	out = binary.BigEndian.AppendUint64(out, state.PreimageOffset)
+	out = binary.BigEndian.AppendUint64(out, state.PC)
+	out = append(out, state.ExitCode)
+	if state.Exited {
+		out = append(out, 1)
+	} else {
+		out = append(out, 0)
+	}
+	out = binary.BigEndian.AppendUint64(out, state.Step)
+	out = binary.BigEndian.AppendUint64(out, state.Heap)
+	out = binary.BigEndian.AppendUint64(out, state.LoadReservation)
+	for _, r := range state.Registers {
+		out = binary.BigEndian.AppendUint64(out, r)
+	}
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("failed to write state scalars: %w", err)
+	}
+
+	var tmp [8]byte
+	binary.BigEndian.PutUint32(tmp[:4], uint32(len(state.LastHint)))
+	if _, err := w.Write(tmp[:4]); err != nil {
+		return fmt.Errorf("failed to write last hint length: %w", err)
+	}
+	if _, err := w.Write(state.LastHint); err != nil {
+		return fmt.Errorf("failed to write last hint: %w", err)
+	}
+
+	pageIndices := state.Memory.sortedPageIndices()
+	table := make([]byte, 0, 8+8*len(pageIndices))
+	table = binary.BigEndian.AppendUint64(table, uint64(len(pageIndices)))
+	for _, pageIndex := range pageIndices {
+		table = binary.BigEndian.AppendUint64(table, pageIndex)
+	}
+	if _, err := w.Write(table); err != nil {
+		return fmt.Errorf("failed to write page table: %w", err)
+	}
+	for _, pageIndex := range pageIndices {
+		p, _ := state.Memory.page(pageIndex)
+		if _, err := w.Write(p.Data[:]); err != nil {
+			return fmt.Errorf("failed to write page %x: %w", pageIndex, err)
+		}
+	}
+	hasMerkleCache := byte(0)
+	if withMerkleCache {
+		hasMerkleCache = 1
+	}
+	if _, err := w.Write([]byte{hasMerkleCache}); err != nil {
+		return fmt.Errorf("failed to write merkle cache flag: %w", err)
+	}
+	if !withMerkleCache {
+		return nil
+	}
+	if err := state.Memory.SerializeMerkleCache(w); err != nil {
+		return fmt.Errorf("failed to write merkle cache: %w", err)
+	}
+	return nil
+}
+
+// Deserialize reads a state in the binary state format, replacing the contents of the state.
+// It reads no further than the end of the state.
+func (state *VMState) Deserialize(r io.Reader) error {
+	var buf [stateBinaryScalarsSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return fmt.Errorf("failed to read state scalars: %w", err)
+	}
+	if string(buf[:8]) != StateBinaryMagic {
+		return errors.New("not a binary state, invalid magic")
+	}
+	in := buf[8:]
+	next := func(n int) []byte {
+		out := in[:n]
+		in = in[n:]
+		return out
+	}
+	version := binary.BigEndian.Uint32(next(4))
+	if version == 0 || version > StateBinaryVersion {
+		return fmt.Errorf("unsupported binary state version %d, expected at most %d", version, StateBinaryVersion)
+	}
+	copy(state.PreimageKey[:], next(32))
+	state.PreimageOffset = binary.BigEndian.Uint64(next(8))
+	state.PC = binary.BigEndian.Uint64(next(8))
+	state.ExitCode = next(1)[0]
+	switch exited := next(1)[0]; exited {
+	case 0:
+		state.Exited = false
+	case 1:
+		state.Exited = true
+	default:
+		return fmt.Errorf("invalid exited flag %d", exited)
+	}
+	state.Step = binary.BigEndian.Uint64(next(8))
+	state.Heap = binary.BigEndian.Uint64(next(8))
+	state.LoadReservation = binary.BigEndian.Uint64(next(8))
+	for i := range state.Registers {
+		state.Registers[i] = binary.BigEndian.Uint64(next(8))
+	}
+
+	var tmp [8]byte
+	if _, err := io.ReadFull(r, tmp[:4]); err != nil {
+		return fmt.Errorf("failed to read last hint length: %w", err)
+	}
+	state.LastHint = nil
+	if n := binary.BigEndian.Uint32(tmp[:4]); n > 0 {
+		// the length is not trusted to allocate the hint upfront, the buffer grows with the data that is read
+		var hint bytes.Buffer
+		if _, err := io.CopyN(&hint, r, int64(n)); err != nil {
+			return fmt.Errorf("failed to read last hint: %w", err)
+		}
+		state.LastHint = hint.Bytes()
+	}
+
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		return fmt.Errorf("failed to read page count: %w", err)
+	}
+	pageCount := binary.BigEndian.Uint64(tmp[:])
+	if pageCount > 1<<PageKeySize {
+		return fmt.Errorf("page count %d exceeds the address space", pageCount)
+	}
+	// read the table entry by entry, the page count is not trusted to allocate the full table upfront
+	var pageIndices []uint64
+	for i := uint64(0); i < pageCount; i++ {
+		if _, err := io.ReadFull(r, tmp[:]); err != nil {
+			return fmt.Errorf("failed to read page table entry %d: %w", i, err)
+		}
+		pageIndex := binary.BigEndian.Uint64(tmp[:])
+		if i > 0 && pageIndex <= pageIndices[i-1] {
+			return fmt.Errorf("page table is not strictly ascending at entry %d: %x", i, pageIndex)
+		}
+		if pageIndex >= 1<<PageKeySize {
+			return fmt.Errorf("page index %x out of range", pageIndex)
+		}
+		pageIndices = append(pageIndices, pageIndex)
+	}
+	state.Memory = NewMemory()
+	for _, pageIndex := range pageIndices {
+		p := state.Memory.AllocPage(pageIndex)
+		if _, err := io.ReadFull(r, p.Data[:]); err != nil {
+			return fmt.Errorf("failed to read page %x: %w", pageIndex, err)
+		}
+	}
+	if version < 2 {
+		return nil
+	}
+	if _, err := io.ReadFull(r, tmp[:1]); err != nil {
+		return fmt.Errorf("failed to read merkle cache flag: %w", err)
+	}
+	switch tmp[0] {
+	case 0:
+		return nil
+	case 1:
+		if err := state.Memory.DeserializeMerkleCache(r); err != nil {
+			return fmt.Errorf("failed to restore merkle cache: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid merkle cache flag %d", tmp[0])
+	}
+}
@@ -0,0 +1,128 @@
+package fast
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMStateClone(t *testing.T) {
+	state := newTestState([]uint32{
+		1<<20 | 10<<15 | 10<<7 | 0x13,  // addi a0, a0, 1
+		10<<20 | 11<<15 | 3<<12 | 0x23, // sd a0, 0(a1)
+		0xff9ff06f,                     // jal zero, -8
+	})
+	state.LastHint = []byte{0, 0, 0, 1}
+	state.Registers[11] = 0x8000
+
+	run := func(s *VMState, steps uint64) {
+		us := NewInstrumentedState(s, nil, nil, nil)
+		us.SetDecodeCache(true)
+		target := s.Step + steps
+		require.NoError(t, us.RunUntil(context.Background(), func(s *VMState) bool {
+			return s.Step >= target
+		}))
+	}
+	run(state, 30)
+
+	fork := state.Clone()
+	require.Equal(t, state.EncodeWitness(), fork.EncodeWitness(), "clone must have same witness")
+
+	run(fork, 300)
+	require.Equal(t, uint64(30), state.Step, "original is unchanged")
+	require.Equal(t, uint64(10), state.Registers[10])
+
+	run(state, 300)
+	require.Equal(t, state.EncodeWitness(), fork.EncodeWitness(), "same execution from the fork point")
+
+	fork.LastHint[3] = 2
+	require.Equal(t, byte(1), state.LastHint[3], "last hint is copied")
+}
+
+func TestVMStateSerialize(t *testing.T) {
+	state := NewVMState()
+	state.PC = 0x1234
+	state.Step = 42
+	state.Exited = true
+	state.ExitCode = 3
+	state.PreimageKey[0] = 2
+	state.PreimageOffset = 8
+	state.LoadReservation = 0x99
+	state.LastHint = []byte{0, 0, 0, 2, 0xaa}
+	for i := range state.Registers {
+		state.Registers[i] = uint64(i) * 0x0101_0101
+	}
+	state.Memory.SetUnaligned(0x1000, []byte{1, 2, 3})
+	state.Memory.SetUnaligned(0xff_0000_0000, []byte{4})
+	state.Memory.SetUnaligned(0x8000, []byte{5})
+
+	var buf bytes.Buffer
+	require.NoError(t, state.Serialize(&buf))
+	buf.WriteString("trailer")
+
+	var out VMState
+	require.NoError(t, out.Deserialize(&buf))
+	require.Equal(t, "trailer", buf.String(), "must not read past the state")
+	require.Equal(t, state.EncodeWitness(), out.EncodeWitness())
+	require.Equal(t, state.LastHint, out.LastHint)
+	require.Equal(t, 3, out.Memory.PageCount())
+
+	t.Run("invalid", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, state.Serialize(&buf))
+		dat := buf.Bytes()
+		require.ErrorContains(t, new(VMState).Deserialize(bytes.NewReader(dat[:len(dat)-2])), "failed to read page")
+		bad := append([]byte{}, dat...)
+		bad[0] = 'x'
+		require.ErrorContains(t, new(VMState).Deserialize(bytes.NewReader(bad)), "invalid magic")
+		bad = append([]byte{}, dat...)
+		bad[11] = 9
+		require.ErrorContains(t, new(VMState).Deserialize(bytes.NewReader(bad)), "unsupported binary state version")
+		bad = append([]byte{}, dat[:stateBinaryScalarsSize+4+2]...)
+		copy(bad[stateBinaryScalarsSize:], []byte{0xff, 0xff, 0xff, 0xff}) // last hint length
+		require.ErrorContains(t, new(VMState).Deserialize(bytes.NewReader(bad)), "failed to read last hint")
+	})
+}
+
+func TestVMStateSerializeMerkleCache(t *testing.T) {
+	state := NewVMState()
+	state.Memory.SetUnaligned(0x1000, []byte{1, 2, 3})
+	state.Memory.SetUnaligned(0xff_0000_0000, []byte{4})
+	state.Memory.SetUnaligned(0x8000_0000_0000_8000, []byte{5})
+	expected := state.EncodeWitness()
+
+	var buf bytes.Buffer
+	require.NoError(t, state.SerializeWithMerkleCache(&buf))
+	dat := buf.Bytes()
+
+	var out VMState
+	require.NoError(t, out.Deserialize(bytes.NewReader(dat)))
+	for _, pageIndex := range out.Memory.sortedPageIndices() {
+		p, _ := out.Memory.page(pageIndex)
+		require.True(t, p.Ok[1], "page root is restored")
+		require.False(t, p.Ok[2], "nodes within the page are not restored")
+	}
+	require.Equal(t, expected, out.EncodeWitness())
+
+	// the restored cache must remain usable for proofs and later writes
+	require.Equal(t, state.Memory.MerkleProof(0x1000), out.Memory.MerkleProof(0x1000))
+	state.Memory.SetUnaligned(0x1001, []byte{6})
+	out.Memory.SetUnaligned(0x1001, []byte{6})
+	require.Equal(t, state.EncodeWitness(), out.EncodeWitness())
+
+	t.Run("corrupt", func(t *testing.T) {
+		bad := append([]byte{}, dat...)
+		bad[len(bad)-1] ^= 1 // last intermediate node of the radix tree
+		require.ErrorContains(t, new(VMState).Deserialize(bytes.NewReader(bad)), "does not match its children")
+		bad = append([]byte{}, dat...)
+		var noCache bytes.Buffer
+		require.NoError(t, state.Serialize(&noCache))
+		bad[noCache.Len()] ^= 1 // stored root
+		require.ErrorContains(t, new(VMState).Deserialize(bytes.NewReader(bad)), "does not match stored root")
+		bad = append([]byte{}, dat...)
+		bad[noCache.Len()-2] ^= 1 // last byte of the last page, with a stale cache
+		require.ErrorContains(t, new(VMState).Deserialize(bytes.NewReader(bad)), "does not match the page data")
+	})
+}
@@ -0,0 +1,136 @@
+package fast
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SyscallPolicy is the action of the strict syscall mode on a syscall that the VM only emulates,
+// by ignoring it or answering it with fixed results.
+type SyscallPolicy uint8
+
+const (
+	// SyscallAllow handles the syscall as usual.
+	SyscallAllow SyscallPolicy = iota
+	// SyscallWarn handles the syscall as usual, and reports it to the warn function.
+	SyscallWarn
+	// SyscallFail fails the step with a SyscallViolation error.
+	SyscallFail
+)
+
+// mapAnonymous is the MAP_ANONYMOUS flag of mmap, the only kind of mapping that the VM supports.
+const mapAnonymous = 0x20
+
+// emulatedSyscalls are the syscalls that the VM handles without performing them, with the reason to report.
+// The default policy applies to them.
+var emulatedSyscalls = map[uint64]string{
+	20:  "ignored, returns 0",                    // epoll_create1
+	21:  "ignored, returns 0",                    // epoll_ctl
+	56:  "always fails with EACCES",              // openat
+	59:  "ignored, returns 0 without fds",        // pipe2
+	78:  "ignored, returns 0 without a path",     // readlinkat
+	79:  "ignored, returns 0 without a stat",     // newfstatat
+	215: "ignored, memory is not unmapped",       // munmap
+	233: "ignored, returns 0",                    // madvise
+	278: "ignored, returns 0 without randomness", // getrandom
+}
+
+// runtimeSyscalls are the emulated syscalls that the Go runtime makes on every startup.
+// They are only checked if their policy is overridden, to not report every Go program.
+var runtimeSyscalls = map[uint64]string{
+	113: "returns a fixed time",                 // clock_gettime
+	123: "ignored, returns 0",                   // sched_getaffinity
+	132: "ignored, returns 0",                   // sigaltstack
+	134: "ignored, returns 0",                   // rt_sigaction
+	135: "ignored, returns 0",                   // rt_sigprocmask
+	160: "ignored, returns 0 without a utsname", // newuname
+	178: "returns a fixed thread id 0",          // gettid
+	220: "threads are not supported, returns 1", // clone
+}
+
+// CheckedSyscalls returns the numbers of the emulated syscalls that the strict syscall mode can check, in ascending order.
+func CheckedSyscalls() []uint64 {
+	nums := make([]uint64, 0, len(emulatedSyscalls)+len(runtimeSyscalls))
+	for num := range emulatedSyscalls {
+		nums = append(nums, num)
+	}
+	for num := range runtimeSyscalls {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
+}
+
+// StrictSyscalls is the policy of the strict syscall mode, to surface guest dependencies on emulated syscalls.
+// Strict mode is for off-chain tooling only: syscalls that are allowed or warned about execute as usual,
+// and failed steps are not provable.
+type StrictSyscalls struct {
+	// Default is the policy of the emulated syscalls without an override.
+	Default SyscallPolicy
+	// Policies overrides the policy per syscall number.
+	// The emulated syscalls that the Go runtime makes on startup, like clock_gettime and rt_sigaction,
+	// are only checked with an override.
+	// The mmap policy applies to mmap calls without the MAP_ANONYMOUS flag, which are handled as anonymous mappings,
+	// and, only with an override, to mmap calls with an address hint, which is returned without allocating memory.
+	// The Go runtime reserves its heap arenas at address hints.
+	Policies map[uint64]SyscallPolicy
+	// Warn is called with the syscalls of the SyscallWarn policy, if not nil.
+	Warn func(v *SyscallViolation)
+}
+
+// SyscallViolation is an emulated syscall that the guest made in strict mode.
+type SyscallViolation struct {
+	// Step and PC of the ecall instruction
+	Step uint64
+	PC   uint64
+
+	Num uint64
+	// Args are the a0-a5 registers of the syscall.
+	Args   [6]uint64
+	Reason string
+}
+
+func (v *SyscallViolation) Error() string {
+	return fmt.Sprintf("%s syscall at step %d (PC: %08x): %s", SyscallName(v.Num), v.Step, v.PC, v.Reason)
+}
+
+// SetStrictSyscalls enables the strict syscall mode with the given policy, or disables it if nil.
+func (m *InstrumentedState) SetStrictSyscalls(strict *StrictSyscalls) {
+	m.strict = strict
+}
+
+// checkSyscall applies the strict syscall policy to the syscall, before it is handled.
+// The step counter of the state is already incremented when the syscall is handled.
+func (m *InstrumentedState) checkSyscall(num uint64) error {
+	s := m.state
+	policy, overridden := m.strict.Policies[num]
+	if !overridden {
+		policy = m.strict.Default
+	}
+	reason, ok := emulatedSyscalls[num]
+	if !ok && overridden {
+		reason, ok = runtimeSyscalls[num]
+	}
+	if num == 222 { // mmap, address hint in a0, flags in a3
+		if s.Registers[13]&mapAnonymous == 0 {
+			reason, ok = "not MAP_ANONYMOUS, mapped as anonymous memory", true
+		} else if s.Registers[10] != 0 && overridden {
+			reason, ok = "address hint returned without allocating memory", true
+		}
+	}
+	if !ok {
+		return nil
+	}
+	if policy == SyscallAllow {
+		return nil
+	}
+	v := &SyscallViolation{Step: s.Step - 1, PC: s.PC, Num: num, Reason: reason}
+	copy(v.Args[:], s.Registers[10:16])
+	if policy == SyscallFail {
+		return v
+	}
+	if m.strict.Warn != nil {
+		m.strict.Warn(v)
+	}
+	return nil
+}
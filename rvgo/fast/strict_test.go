@@ -0,0 +1,96 @@
+package fast
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrictSyscalls(t *testing.T) {
+	// a program that maps file-backed memory, maps anonymous memory, calls madvise, and exits
+	program := []uint32{
+		222<<20 | 17<<7 | 0x13,  // addi a7, zero, 222
+		0x73,                    // ecall
+		0x22<<20 | 13<<7 | 0x13, // addi a3, zero, 0x22
+		0x73,                    // ecall
+		233<<20 | 17<<7 | 0x13,  // addi a7, zero, 233
+		0x73,                    // ecall
+		93<<20 | 17<<7 | 0x13,   // addi a7, zero, 93
+		0x73,                    // ecall
+	}
+	initState := newTestState(program)
+	initState.Heap = 0x2000_0000
+	initState.Registers[11] = 0x1000
+	run := func(strict *StrictSyscalls) (*VMState, error) {
+		state := initState.Clone()
+		us := NewInstrumentedState(state, nil, nil, nil)
+		us.SetDecodeCache(true)
+		us.SetStrictSyscalls(strict)
+		return state, us.RunUntil(context.Background(), nil)
+	}
+	ref, err := run(nil)
+	require.NoError(t, err)
+	require.True(t, ref.Exited)
+
+	var warnings []SyscallViolation
+	warn := func(v *SyscallViolation) {
+		warnings = append(warnings, *v)
+	}
+	state, err := run(&StrictSyscalls{Default: SyscallWarn, Warn: warn})
+	require.NoError(t, err)
+	require.Equal(t, ref.EncodeWitness(), state.EncodeWitness(), "warnings do not change execution")
+	require.Equal(t, []SyscallViolation{
+		{Step: 1, PC: 0x1004, Num: 222, Args: [6]uint64{0, 0x1000}, Reason: "not MAP_ANONYMOUS, mapped as anonymous memory"},
+		{Step: 5, PC: 0x1014, Num: 233, Args: [6]uint64{0x2000_0000, 0, 0, 0x22}, Reason: "ignored, returns 0"},
+	}, warnings)
+
+	warnings = nil
+	_, err = run(&StrictSyscalls{Default: SyscallWarn, Policies: map[uint64]SyscallPolicy{233: SyscallAllow}, Warn: warn})
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	require.Equal(t, uint64(222), warnings[0].Num)
+
+	state, err = run(&StrictSyscalls{Default: SyscallAllow, Policies: map[uint64]SyscallPolicy{233: SyscallFail}})
+	require.ErrorContains(t, err, "madvise syscall at step 5 (PC: 00001014): ignored, returns 0")
+	require.False(t, state.Exited)
+}
+
+func TestStrictSyscallsOverrides(t *testing.T) {
+	// a program that gets the time, maps anonymous memory at an address hint, and exits
+	program := []uint32{
+		113<<20 | 17<<7 | 0x13,    // addi a7, zero, 113
+		3<<12 | 11<<7 | 0x37,      // lui a1, 3
+		0x73,                      // ecall
+		222<<20 | 17<<7 | 0x13,    // addi a7, zero, 222
+		0x4000<<12 | 10<<7 | 0x37, // lui a0, 0x4000
+		0x22<<20 | 13<<7 | 0x13,   // addi a3, zero, 0x22
+		0x73,                      // ecall
+		93<<20 | 17<<7 | 0x13,     // addi a7, zero, 93
+		0x73,                      // ecall
+	}
+	initState := newTestState(program)
+	initState.Heap = 0x2000_0000
+	var warnings []SyscallViolation
+	run := func(strict *StrictSyscalls) {
+		warnings = nil
+		strict.Warn = func(v *SyscallViolation) {
+			warnings = append(warnings, *v)
+		}
+		us := NewInstrumentedState(initState.Clone(), nil, nil, nil)
+		us.SetDecodeCache(true)
+		us.SetStrictSyscalls(strict)
+		require.NoError(t, us.RunUntil(context.Background(), nil))
+	}
+
+	run(&StrictSyscalls{Default: SyscallWarn})
+	require.Empty(t, warnings, "syscalls of the Go runtime startup are not checked by default")
+
+	run(&StrictSyscalls{Default: SyscallAllow, Policies: map[uint64]SyscallPolicy{113: SyscallWarn, 222: SyscallWarn}})
+	require.Len(t, warnings, 2)
+	require.Equal(t, uint64(113), warnings[0].Num)
+	require.Equal(t, "returns a fixed time", warnings[0].Reason)
+	require.Equal(t, uint64(222), warnings[1].Num)
+	require.Equal(t, uint64(0x400_0000), warnings[1].Args[0])
+	require.Equal(t, "address hint returned without allocating memory", warnings[1].Reason)
+}
@@ -0,0 +1,99 @@
+package fast
+
+import "fmt"
+
+// syscallNames are the names of the Linux riscv64 syscalls that sysCall in vm.go has a case for,
+// including the ones that it fails as not supported.
+var syscallNames = map[uint64]string{
+	20:  "epoll_create1",
+	21:  "epoll_ctl",
+	25:  "fcntl",
+	56:  "openat",
+	59:  "pipe2",
+	63:  "read",
+	64:  "write",
+	78:  "readlinkat",
+	79:  "newfstatat",
+	93:  "exit",
+	94:  "exit_group",
+	101: "nanosleep",
+	113: "clock_gettime",
+	123: "sched_getaffinity",
+	124: "sched_yield",
+	132: "sigaltstack",
+	134: "rt_sigaction",
+	135: "rt_sigprocmask",
+	160: "newuname",
+	163: "getrlimit",
+	178: "gettid",
+	214: "brk",
+	215: "munmap",
+	220: "clone",
+	222: "mmap",
+	233: "madvise",
+	261: "prlimit64",
+	278: "getrandom",
+	422: "futex",
+}
+
+// SyscallName returns the name of the syscall with the given number, e.g. "mmap",
+// or the number as "sys_<num>" if the VM does not handle the syscall.
+func SyscallName(num uint64) string {
+	if name, ok := syscallNames[num]; ok {
+		return name
+	}
+	return fmt.Sprintf("sys_%d", num)
+}
+
+// SyscallRecord is a syscall that the VM handled, with its arguments and results, as passed to Tracer.OnSyscall.
+type SyscallRecord struct {
+	// Step and PC of the ecall instruction
+	Step uint64 `json:"step"`
+	PC   uint64 `json:"pc"`
+
+	Num uint64 `json:"num"`
+	// Args are the a0-a5 registers before the syscall.
+	Args [6]uint64 `json:"args"`
+	// Ret and Err are the a0 and a1 registers after the syscall: the return value and the error code.
+	// The exit syscalls do not change them.
+	Ret uint64 `json:"ret"`
+	Err uint64 `json:"err"`
+	// Failure is the error of a syscall that the VM does not support, which fails the step.
+	// Ret and Err are not set then.
+	Failure string `json:"failure,omitempty"`
+}
+
+// syscallEnter records the syscall number and arguments, before the syscall is handled.
+// The step counter of the state is already incremented when the syscall is handled.
+func (m *InstrumentedState) syscallEnter() {
+	s := m.state
+	m.syscall = SyscallRecord{
+		Step: s.Step - 1,
+		PC:   s.PC,
+		Num:  s.Registers[17],
+	}
+	copy(m.syscall.Args[:], s.Registers[10:16])
+}
+
+// syscallExit records the results of the syscall, and passes the record to the tracer.
+func (m *InstrumentedState) syscallExit() {
+	m.syscall.Ret = m.state.Registers[10]
+	m.syscall.Err = m.state.Registers[11]
+	m.tracer.OnSyscall(&m.syscall)
+}
+
+// syscallFailed records the error of a syscall that fails the step, and passes the record to the tracer.
+func (m *InstrumentedState) syscallFailed(err error) {
+	m.syscall.Failure = err.Error()
+	m.tracer.OnSyscall(&m.syscall)
+}
+
+// SyscallNumber returns the number of the syscall with the given name, if the VM handles the syscall.
+func SyscallNumber(name string) (uint64, bool) {
+	for num, n := range syscallNames {
+		if n == name {
+			return num, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,100 @@
+package fast
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syscallTracer records the syscalls of the steps.
+type syscallTracer struct {
+	NoopTracer
+	records []SyscallRecord
+}
+
+func (tr *syscallTracer) OnSyscall(rec *SyscallRecord) {
+	tr.records = append(tr.records, *rec)
+}
+
+func TestSyscallTracer(t *testing.T) {
+	// a program that maps memory, opens a file, and exits with code 3
+	program := []uint32{
+		222<<20 | 17<<7 | 0x13, // addi a7, zero, 222
+		1<<12 | 11<<7 | 0x37,   // lui a1, 1
+		0x73,                   // ecall
+		56<<20 | 17<<7 | 0x13,  // addi a7, zero, 56
+		0x73,                   // ecall
+		3<<20 | 10<<7 | 0x13,   // addi a0, zero, 3
+		93<<20 | 17<<7 | 0x13,  // addi a7, zero, 93
+		0x73,                   // ecall
+	}
+	state := newTestState(program)
+	state.Heap = 0x2000_0000
+
+	us := NewInstrumentedState(state, nil, nil, nil)
+	us.SetDecodeCache(true)
+	tr := &syscallTracer{}
+	us.SetTracer(tr)
+	require.NoError(t, us.RunUntil(context.Background(), nil))
+	require.True(t, state.Exited)
+	require.Equal(t, []SyscallRecord{
+		{Step: 2, PC: 0x1008, Num: 222, Args: [6]uint64{0, 0x1000}, Ret: 0x2000_0000},
+		{Step: 4, PC: 0x1010, Num: 56, Args: [6]uint64{0x2000_0000}, Ret: ^uint64(0), Err: 0xd},
+		{Step: 7, PC: 0x101c, Num: 93, Args: [6]uint64{3, 0xd}, Ret: 3, Err: 0xd}, // exit does not change a0 and a1
+	}, tr.records)
+}
+
+func TestSyscallTracerUnsupported(t *testing.T) {
+	// a program that calls futex, which the VM does not support
+	program := []uint32{
+		422<<20 | 17<<7 | 0x13, // addi a7, zero, 422
+		0x73,                   // ecall
+	}
+	state := newTestState(program)
+
+	us := NewInstrumentedState(state, nil, nil, nil)
+	us.SetDecodeCache(true)
+	tr := &syscallTracer{}
+	us.SetTracer(tr)
+	require.ErrorContains(t, us.RunUntil(context.Background(), nil), "unsupported system call: 422")
+	require.Equal(t, []SyscallRecord{
+		{Step: 1, PC: 0x1004, Num: 422, Failure: "unsupported system call: 422"},
+	}, tr.records, "the syscall is recorded before the step fails")
+}
+
+func TestSyscallNames(t *testing.T) {
+	// walk the cases of the syscall switch in vm.go, to keep the names in sync with the handled syscalls
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "vm.go", nil, 0)
+	require.NoError(t, err)
+	var nums []uint64
+	ast.Inspect(f, func(n ast.Node) bool {
+		sw, ok := n.(*ast.SwitchStmt)
+		if !ok {
+			return true
+		}
+		if tag, ok := sw.Tag.(*ast.Ident); !ok || tag.Name != "a7" {
+			return true
+		}
+		for _, stmt := range sw.Body.List {
+			for _, expr := range stmt.(*ast.CaseClause).List {
+				lit, ok := expr.(*ast.BasicLit)
+				require.True(t, ok, "syscall case at %s is not a number", fset.Position(expr.Pos()))
+				num, err := strconv.ParseUint(lit.Value, 0, 64)
+				require.NoError(t, err)
+				nums = append(nums, num)
+			}
+		}
+		return false
+	})
+	require.NotEmpty(t, nums, "syscall switch not found")
+	for _, num := range nums {
+		require.Contains(t, syscallNames, num, "name of syscall %d", num)
+	}
+	require.Len(t, syscallNames, len(nums), "names of syscalls that the VM does not handle")
+}
@@ -0,0 +1,119 @@
+package fast
+
+// Tracer receives the events of executed steps, to build tools like trace exporters and profilers on,
+// without changing the VM. Steps with a tracer run with riscvStep, and do not use the decode cache.
+// Byte slices passed to the hooks are only valid during the call.
+type Tracer interface {
+	// OnInstruction is called before the instruction of a step executes, with the step number, PC and raw instruction.
+	OnInstruction(step uint64, pc uint64, instr uint32)
+	// OnRegisterWrite is called when a register is written, with its previous and new value.
+	// Writes to register 0 are ignored by the VM, and are not reported.
+	OnRegisterWrite(reg uint64, prev uint64, value uint64)
+	// OnMemoryRead is called with the address and data of a guest memory load. Instruction fetches are not reported.
+	OnMemoryRead(addr uint64, data []byte)
+	// OnMemoryWrite is called with the address and data of a guest memory store,
+	// including the writes of pre-image data by the read syscall.
+	OnMemoryWrite(addr uint64, data []byte)
+	// OnSyscall is called after a syscall is handled, or before the step fails on a syscall that the VM does not support.
+	OnSyscall(rec *SyscallRecord)
+	// OnPreimageRead is called when pre-image data is read, with the pre-image key,
+	// the offset of the data in the pre-image with its 8-byte length prefix, and the data.
+	OnPreimageRead(key [32]byte, offset uint64, data []byte)
+	// OnHint is called with every complete hint that the guest wrote, before it is passed to the pre-image oracle.
+	OnHint(hint []byte)
+}
+
+// NoopTracer implements Tracer with hooks that do nothing, to embed in tracers that only implement some of the hooks.
+type NoopTracer struct{}
+
+var _ Tracer = NoopTracer{}
+
+func (NoopTracer) OnInstruction(step uint64, pc uint64, instr uint32)      {}
+func (NoopTracer) OnRegisterWrite(reg uint64, prev uint64, value uint64)   {}
+func (NoopTracer) OnMemoryRead(addr uint64, data []byte)                   {}
+func (NoopTracer) OnMemoryWrite(addr uint64, data []byte)                  {}
+func (NoopTracer) OnSyscall(rec *SyscallRecord)                            {}
+func (NoopTracer) OnPreimageRead(key [32]byte, offset uint64, data []byte) {}
+func (NoopTracer) OnHint(hint []byte)                                      {}
+
+// SetTracer sets the tracer to call with the events of executed steps, or nil to stop tracing.
+// Without a tracer, the hooks cost a nil check.
+func (m *InstrumentedState) SetTracer(t Tracer) {
+	m.userTracer = t
+	m.updateTracer()
+}
+
+// updateTracer sets the tracer that the steps call: the tracer of SetTracer, and the watchpoints, if any.
+func (m *InstrumentedState) updateTracer() {
+	switch {
+	case m.watch == nil:
+		m.tracer = m.userTracer
+	case m.userTracer == nil:
+		m.tracer = m.watch
+	default:
+		m.tracer = tracers{m.userTracer, m.watch}
+	}
+}
+
+// tracers passes the events to multiple tracers, in order.
+type tracers []Tracer
+
+func (ts tracers) OnInstruction(step uint64, pc uint64, instr uint32) {
+	for _, t := range ts {
+		t.OnInstruction(step, pc, instr)
+	}
+}
+
+func (ts tracers) OnRegisterWrite(reg uint64, prev uint64, value uint64) {
+	for _, t := range ts {
+		t.OnRegisterWrite(reg, prev, value)
+	}
+}
+
+func (ts tracers) OnMemoryRead(addr uint64, data []byte) {
+	for _, t := range ts {
+		t.OnMemoryRead(addr, data)
+	}
+}
+
+func (ts tracers) OnMemoryWrite(addr uint64, data []byte) {
+	for _, t := range ts {
+		t.OnMemoryWrite(addr, data)
+	}
+}
+
+func (ts tracers) OnSyscall(rec *SyscallRecord) {
+	for _, t := range ts {
+		t.OnSyscall(rec)
+	}
+}
+
+func (ts tracers) OnPreimageRead(key [32]byte, offset uint64, data []byte) {
+	for _, t := range ts {
+		t.OnPreimageRead(key, offset, data)
+	}
+}
+
+func (ts tracers) OnHint(hint []byte) {
+	for _, t := range ts {
+		t.OnHint(hint)
+	}
+}
+
+// The trace helpers pass a copy of the data to the tracer, so the data of the step does not escape to the heap,
+// when no tracer is set.
+
+func (m *InstrumentedState) traceMemoryRead(addr uint64, data []byte) {
+	n := copy(m.traceData[:], data)
+	m.tracer.OnMemoryRead(addr, m.traceData[:n])
+}
+
+func (m *InstrumentedState) traceMemoryWrite(addr uint64, data []byte) {
+	n := copy(m.traceData[:], data)
+	m.tracer.OnMemoryWrite(addr, m.traceData[:n])
+}
+
+func (m *InstrumentedState) tracePreimageRead(key [32]byte, offset uint64, data []byte) {
+	n := copy(m.traceData[:], data)
+	m.tracer.OnPreimageRead(key, offset, m.traceData[:n])
+}
@@ -0,0 +1,117 @@
+package fast
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTraceMemory struct {
+	addr uint64
+	data []byte
+}
+
+type testTracePreimage struct {
+	key    [32]byte
+	offset uint64
+	data   []byte
+}
+
+type testTracer struct {
+	NoopTracer
+	pcs       []uint64
+	regWrites [][3]uint64
+	reads     []testTraceMemory
+	writes    []testTraceMemory
+	syscalls  []uint64
+	preimages []testTracePreimage
+	hints     []string
+}
+
+func (tr *testTracer) OnInstruction(step uint64, pc uint64, instr uint32) {
+	tr.pcs = append(tr.pcs, pc)
+}
+
+func (tr *testTracer) OnRegisterWrite(reg uint64, prev uint64, value uint64) {
+	tr.regWrites = append(tr.regWrites, [3]uint64{reg, prev, value})
+}
+
+func (tr *testTracer) OnMemoryRead(addr uint64, data []byte) {
+	tr.reads = append(tr.reads, testTraceMemory{addr, append([]byte(nil), data...)})
+}
+
+func (tr *testTracer) OnMemoryWrite(addr uint64, data []byte) {
+	tr.writes = append(tr.writes, testTraceMemory{addr, append([]byte(nil), data...)})
+}
+
+func (tr *testTracer) OnSyscall(rec *SyscallRecord) {
+	tr.syscalls = append(tr.syscalls, rec.Num)
+}
+
+func (tr *testTracer) OnPreimageRead(key [32]byte, offset uint64, data []byte) {
+	tr.preimages = append(tr.preimages, testTracePreimage{key, offset, append([]byte(nil), data...)})
+}
+
+func (tr *testTracer) OnHint(hint []byte) {
+	tr.hints = append(tr.hints, string(hint))
+}
+
+func TestTracer(t *testing.T) {
+	// a program that writes a hint and a pre-image key, reads the pre-image length prefix, loads it, and exits
+	program := []uint32{
+		4<<20 | 10<<7 | 0x13,          // addi a0, zero, 4
+		4<<12 | 11<<7 | 0x37,          // lui a1, 4
+		6<<20 | 12<<7 | 0x13,          // addi a2, zero, 6
+		64<<20 | 17<<7 | 0x13,         // addi a7, zero, 64
+		0x73,                          // ecall
+		6<<20 | 10<<7 | 0x13,          // addi a0, zero, 6
+		2<<12 | 11<<7 | 0x37,          // lui a1, 2
+		32<<20 | 12<<7 | 0x13,         // addi a2, zero, 32
+		0x73,                          // ecall
+		5<<20 | 10<<7 | 0x13,          // addi a0, zero, 5
+		3<<12 | 11<<7 | 0x37,          // lui a1, 3
+		8<<20 | 12<<7 | 0x13,          // addi a2, zero, 8
+		63<<20 | 17<<7 | 0x13,         // addi a7, zero, 63
+		0x73,                          // ecall
+		3<<12 | 11<<7 | 0x37,          // lui a1, 3
+		11<<15 | 3<<12 | 13<<7 | 0x03, // ld a3, 0(a1)
+		93<<20 | 17<<7 | 0x13,         // addi a7, zero, 93
+		0x73,                          // ecall
+	}
+	key := [32]byte{0: 2, 31: 1}
+	newState := func() *VMState {
+		s := newTestState(program)
+		s.Memory.SetUnaligned(0x2000, key[:])
+		s.Memory.SetUnaligned(0x4000, []byte("\x00\x00\x00\x02hi"))
+		return s
+	}
+
+	state := newState()
+	us := NewInstrumentedState(state, staticOracle("hello"), nil, nil)
+	us.SetDecodeCache(true)
+	tr := &testTracer{}
+	us.SetTracer(tr)
+	require.NoError(t, us.RunUntil(context.Background(), nil))
+	require.True(t, state.Exited)
+
+	require.Len(t, tr.pcs, len(program))
+	for i, pc := range tr.pcs {
+		require.Equal(t, 0x1000+uint64(i)*4, pc)
+	}
+	require.Equal(t, [3]uint64{10, 0, 4}, tr.regWrites[0])
+	lengthPrefix := []byte{0, 0, 0, 0, 0, 0, 0, 5}
+	require.Contains(t, tr.regWrites, [3]uint64{13, 0, binary.LittleEndian.Uint64(lengthPrefix)}, "load of the length prefix")
+	require.Equal(t, []testTraceMemory{{0x3000, lengthPrefix}}, tr.reads)
+	require.Equal(t, []testTraceMemory{{0x3000, lengthPrefix}}, tr.writes)
+	require.Equal(t, []uint64{64, 64, 63, 93}, tr.syscalls)
+	require.Equal(t, []testTracePreimage{{key, 0, lengthPrefix}}, tr.preimages)
+	require.Equal(t, []string{"hi"}, tr.hints)
+
+	ref := newState()
+	refUs := NewInstrumentedState(ref, staticOracle("hello"), nil, nil)
+	refUs.SetDecodeCache(true)
+	require.NoError(t, refUs.RunUntil(context.Background(), nil))
+	require.Equal(t, ref.EncodeWitness(), state.EncodeWitness(), "tracing does not change execution")
+}
@@ -0,0 +1,172 @@
+package fast
+
+import "fmt"
+
+// undoLog records the state changes of the latest steps, so they can be reverted.
+type undoLog struct {
+	limit int
+	// entries of the latest steps, the last entry is the latest step
+	entries []*undoEntry
+}
+
+// undoEntry holds the previous values of the state that a step wrote.
+type undoEntry struct {
+	// every step changes the PC and the step counter
+	pc   uint64
+	step uint64
+
+	// previous register values, in order of writing
+	regs []undoRegister
+	// previous values of the fields that few steps write, if the step wrote any of them
+	other *undoOther
+	// previous values of the 32-byte memory leaves, before the first write to them in the step
+	leaves []undoLeaf
+}
+
+type undoRegister struct {
+	reg   uint64
+	value uint64
+}
+
+type undoOther struct {
+	preimageKey     [32]byte
+	preimageOffset  uint64
+	exitCode        uint8
+	exited          bool
+	heap            uint64
+	loadReservation uint64
+	lastHint        []byte
+}
+
+type undoLeaf struct {
+	addr uint64
+	data [32]byte
+}
+
+// SetUndoLimit enables an undo log of the state changes of up to limit latest steps, to revert them with StepBack.
+// A limit of 0 disables the undo log. Steps with an undo log do not use the decode cache.
+// The undo log reverts the state, but not the pre-image and hint interactions with the pre-image oracle.
+func (m *InstrumentedState) SetUndoLimit(limit int) {
+	if limit <= 0 {
+		m.undo = nil
+		return
+	}
+	if m.undo == nil {
+		m.undo = &undoLog{}
+	}
+	m.undo.limit = limit
+	m.undo.trim()
+}
+
+// UndoDepth returns the number of steps that can be reverted with StepBack.
+func (m *InstrumentedState) UndoDepth() int {
+	if m.undo == nil {
+		return 0
+	}
+	return len(m.undo.entries)
+}
+
+// StepBack reverts the latest n steps, as recorded in the undo log.
+// Memory pages that the reverted steps allocated are not freed, but are reverted to zeroes,
+// which does not change the memory merkle root.
+func (m *InstrumentedState) StepBack(n int) error {
+	if n < 0 {
+		return fmt.Errorf("cannot step back a negative number of steps: %d", n)
+	}
+	if n > m.UndoDepth() {
+		return fmt.Errorf("cannot step back %d steps, the undo log has %d steps", n, m.UndoDepth())
+	}
+	s := m.state
+	for ; n > 0; n-- {
+		last := len(m.undo.entries) - 1
+		e := m.undo.entries[last]
+		m.undo.entries[last] = nil
+		m.undo.entries = m.undo.entries[:last]
+
+		for i := len(e.leaves) - 1; i >= 0; i-- {
+			s.Memory.SetUnaligned(e.leaves[i].addr, e.leaves[i].data[:])
+		}
+		for i := len(e.regs) - 1; i >= 0; i-- {
+			s.Registers[e.regs[i].reg] = e.regs[i].value
+		}
+		if o := e.other; o != nil {
+			s.PreimageKey = o.preimageKey
+			s.PreimageOffset = o.preimageOffset
+			s.ExitCode = o.exitCode
+			s.Exited = o.exited
+			s.Heap = o.heap
+			s.LoadReservation = o.loadReservation
+			s.LastHint = o.lastHint
+		}
+		s.PC = e.pc
+		s.Step = e.step
+	}
+	if m.watch != nil {
+		m.watch.hits = m.watch.hits[:0]
+	}
+	return nil
+}
+
+// begin starts the entry of a step, before it changes the state.
+func (u *undoLog) begin(s *VMState) {
+	u.entries = append(u.entries, &undoEntry{pc: s.PC, step: s.Step})
+	u.trim()
+}
+
+func (u *undoLog) trim() {
+	if over := len(u.entries) - u.limit; over > 0 {
+		for i := 0; i < over; i++ {
+			u.entries[i] = nil
+		}
+		u.entries = u.entries[over:]
+	}
+}
+
+func (u *undoLog) current() *undoEntry {
+	return u.entries[len(u.entries)-1]
+}
+
+func (u *undoLog) recordRegister(s *VMState, reg uint64) {
+	e := u.current()
+	e.regs = append(e.regs, undoRegister{reg: reg, value: s.Registers[reg]})
+}
+
+// recordOther records the fields that few steps write, before the first write to any of them in the step.
+func (u *undoLog) recordOther(s *VMState) {
+	e := u.current()
+	if e.other != nil {
+		return
+	}
+	e.other = &undoOther{
+		preimageKey:     s.PreimageKey,
+		preimageOffset:  s.PreimageOffset,
+		exitCode:        s.ExitCode,
+		exited:          s.Exited,
+		heap:            s.Heap,
+		loadReservation: s.LoadReservation,
+		lastHint:        append([]byte(nil), s.LastHint...),
+	}
+}
+
+// recordMemory records the 32-byte leaves of the memory range, before the first write to them in the step.
+func (u *undoLog) recordMemory(s *VMState, addr uint64, size uint64) {
+	e := u.current()
+	// count the leaves instead of comparing with the end address, which wraps to 0 at the top of the address space
+	first := addr &^ 31
+	count := ((addr+size-1)&^31-first)/32 + 1
+	for i, leaf := uint64(0), first; i < count; i, leaf = i+1, leaf+32 {
+		recorded := false
+		for i := range e.leaves {
+			if e.leaves[i].addr == leaf {
+				recorded = true
+				break
+			}
+		}
+		if recorded {
+			continue
+		}
+		l := undoLeaf{addr: leaf}
+		s.Memory.GetUnaligned(leaf, l.data[:])
+		e.leaves = append(e.leaves, l)
+	}
+}
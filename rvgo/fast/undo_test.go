@@ -0,0 +1,87 @@
+package fast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepBack(t *testing.T) {
+	// a program that stores an incrementing counter to memory until it reaches 20, maps memory, and exits
+	program := []uint32{
+		1<<20 | 10<<15 | 10<<7 | 0x13,  // addi a0, a0, 1
+		10<<20 | 11<<15 | 3<<12 | 0x23, // sd a0, 0(a1)
+		0xfec54ce3,                     // blt a0, a2, -8
+		222<<20 | 17<<7 | 0x13,         // addi a7, zero, 222
+		10<<7 | 0x13,                   // addi a0, zero, 0
+		1<<12 | 11<<7 | 0x37,           // lui a1, 1
+		0x73,                           // ecall
+		93<<20 | 17<<7 | 0x13,          // addi a7, zero, 93
+		0x73,                           // ecall
+	}
+	state := newTestState(program)
+	state.Registers[11] = 0x8000 - 4 // stores cross a 32-byte leaf boundary
+	state.Registers[12] = 20
+
+	us := NewInstrumentedState(state, nil, nil, nil)
+	us.SetDecodeCache(true)
+	us.SetUndoLimit(1000)
+	var witnesses []StateWitness
+	for !state.Exited {
+		witnesses = append(witnesses, state.EncodeWitness())
+		_, err := us.Step(false)
+		require.NoError(t, err)
+	}
+	final := state.EncodeWitness()
+	require.Equal(t, len(witnesses), us.UndoDepth())
+	require.Error(t, us.StepBack(len(witnesses)+1))
+	require.ErrorContains(t, us.StepBack(-1), "negative")
+
+	for i := len(witnesses) - 1; i >= 0; i-- {
+		require.NoError(t, us.StepBack(1))
+		require.Equal(t, witnesses[i], state.EncodeWitness(), "state after stepping back to step %d", i)
+	}
+	require.Equal(t, 0, us.UndoDepth())
+
+	// running forward again reaches the same state, and the steps can be reverted at once
+	for !state.Exited {
+		_, err := us.Step(false)
+		require.NoError(t, err)
+	}
+	require.Equal(t, final, state.EncodeWitness())
+	require.NoError(t, us.StepBack(10))
+	require.Equal(t, witnesses[len(witnesses)-10], state.EncodeWitness())
+
+	// the undo log only keeps the latest steps
+	us.SetUndoLimit(3)
+	require.Equal(t, 3, us.UndoDepth())
+	require.NoError(t, us.StepBack(3))
+	require.Equal(t, witnesses[len(witnesses)-13], state.EncodeWitness())
+	require.Error(t, us.StepBack(1))
+}
+
+func TestStepBackTopOfMemory(t *testing.T) {
+	// a store to the last bytes of the address space, where the end of the written range wraps to 0
+	state := newTestState([]uint32{
+		10<<20 | 11<<15 | 3<<12 | 0x23, // sd a0, 0(a1)
+		10<<20 | 11<<15 | 3<<12 | 0x23, // sd a0, 0(a1)
+	})
+	state.Registers[10] = 0x0102_0304_0506_0708
+	state.Registers[11] = ^uint64(0) - 7
+	us := NewInstrumentedState(state, nil, nil, nil)
+	us.SetUndoLimit(10)
+	before := state.EncodeWitness()
+	_, err := us.Step(false)
+	require.NoError(t, err)
+	require.NotEqual(t, before, state.EncodeWitness())
+	require.NoError(t, us.StepBack(1))
+	require.Equal(t, before, state.EncodeWitness())
+
+	// a store that crosses the end of the address space
+	state.Registers[11] = ^uint64(0) - 3
+	before = state.EncodeWitness()
+	_, err = us.Step(false)
+	require.NoError(t, err)
+	require.NoError(t, us.StepBack(1))
+	require.Equal(t, before, state.EncodeWitness())
+}
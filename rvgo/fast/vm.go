@@ -66,6 +66,9 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		return s.PreimageKey
 	}
 	setPreimageKey := func(k [32]byte) {
+		if inst.undo != nil {
+			inst.undo.recordOther(s)
+		}
 		s.PreimageKey = k
 	}
 
@@ -73,6 +76,9 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		return s.PreimageOffset
 	}
 	setPreimageOffset := func(v U64) {
+		if inst.undo != nil {
+			inst.undo.recordOther(s)
+		}
 		s.PreimageOffset = v
 	}
 
@@ -87,11 +93,17 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		return s.Exited
 	}
 	setExited := func() {
+		if inst.undo != nil {
+			inst.undo.recordOther(s)
+		}
 		s.Exited = true
 	}
 
 	// no getExitCode necessary
 	setExitCode := func(v uint8) {
+		if inst.undo != nil {
+			inst.undo.recordOther(s)
+		}
 		s.ExitCode = v
 	}
 
@@ -106,6 +118,9 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		return s.Heap
 	}
 	setHeap := func(v U64) {
+		if inst.undo != nil {
+			inst.undo.recordOther(s)
+		}
 		s.Heap = v
 	}
 
@@ -113,6 +128,9 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		return s.LoadReservation
 	}
 	setLoadReservation := func(addr U64) {
+		if inst.undo != nil {
+			inst.undo.recordOther(s)
+		}
 		s.LoadReservation = addr
 	}
 
@@ -132,6 +150,12 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		if reg >= 32 {
 			panic(fmt.Errorf("unknown register %d, cannot write %x", reg, v))
 		}
+		if inst.undo != nil {
+			inst.undo.recordRegister(s, reg)
+		}
+		if inst.tracer != nil {
+			inst.tracer.OnRegisterWrite(reg, s.Registers[reg], v)
+		}
 		s.Registers[reg] = v
 	}
 
@@ -157,6 +181,9 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 			panic(fmt.Errorf("addr %d not aligned with 32 bytes", addr))
 		}
 		inst.verifyMemChange(addr, proofIndex)
+		if inst.undo != nil {
+			inst.undo.recordMemory(s, addr, 32)
+		}
 		s.Memory.SetUnaligned(addr, v[:])
 	}
 
@@ -174,6 +201,9 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		}
 		var v [8]byte
 		s.Memory.GetUnaligned(addr, v[:size])
+		if proofIndexL != 0 && inst.tracer != nil { // proof index 0 is the instruction fetch, not a guest load
+			inst.traceMemoryRead(addr, v[:size])
+		}
 		out = binary.LittleEndian.Uint64(v[:])
 		bitSize := size << 3
 		if signed && out&(1<<(bitSize-1)) != 0 { // if the last bit is set, then extend it to the full 64 bits
@@ -192,6 +222,12 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		binary.LittleEndian.PutUint64(bytez[8:16], value[1])
 		binary.LittleEndian.PutUint64(bytez[16:24], value[2])
 		binary.LittleEndian.PutUint64(bytez[24:], value[3])
+		if inst.tracer != nil {
+			inst.traceMemoryWrite(addr, bytez[:size])
+		}
+		if inst.undo != nil {
+			inst.undo.recordMemory(s, addr, size)
+		}
 
 		leftAddr := addr &^ 31
 		if verifyL {
@@ -222,6 +258,12 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		}
 		var bytez [8]byte
 		binary.LittleEndian.PutUint64(bytez[:], value)
+		if inst.tracer != nil {
+			inst.traceMemoryWrite(addr, bytez[:size])
+		}
+		if inst.undo != nil {
+			inst.undo.recordMemory(s, addr, size)
+		}
 		leftAddr := addr &^ 31
 		if verifyL {
 			inst.trackMemAccess(leftAddr, proofIndexL)
@@ -338,6 +380,10 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 		dat := and(b32asBEWord(node), not(mask)) // keep old bytes outside of mask
 		dat = or(dat, and(pdat, mask))           // fill with bytes from pdat
 		setMemoryB32(sub64(addr, alignment), beWordAsB32(dat), 1)
+		if inst.tracer != nil {
+			inst.tracePreimageRead(preImageKey, offset, pdatB32[:count])
+			inst.traceMemoryWrite(addr, pdatB32[:count])
+		}
 		return count
 	}
 
@@ -346,6 +392,24 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 	//
 	sysCall := func() {
 		a7 := getRegister(toU64(17))
+		if inst.counters != nil {
+			inst.counters.countSyscall(a7)
+		}
+		if inst.tracer != nil {
+			inst.syscallEnter()
+		}
+		// failSyscall reverts on a syscall that the VM does not support, after passing it to the tracer
+		failSyscall := func(code uint64, err error) {
+			if inst.tracer != nil {
+				inst.syscallFailed(err)
+			}
+			revertWithCode(code, err)
+		}
+		if inst.strict != nil {
+			if err := inst.checkSyscall(a7); err != nil {
+				failSyscall(0xf001ca11, err)
+			}
+		}
 		switch a7 {
 		case 93: // exit the calling thread. No multi-thread support yet, so just exit.
 			a0 := getRegister(toU64(10))
@@ -437,12 +501,18 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 				errCode = toU64(0)
 			case fdHintWrite: // hint-write
 				hintData, _ := io.ReadAll(s.Memory.ReadMemoryRange(addr, count))
+				if inst.undo != nil {
+					inst.undo.recordOther(s)
+				}
 				s.LastHint = append(inst.state.LastHint, hintData...)
 				for len(s.LastHint) >= 4 { // process while there is enough data to check if there are any hints
 					hintLen := binary.BigEndian.Uint32(s.LastHint[:4])
 					if hintLen >= uint32(len(s.LastHint[4:])) {
 						hint := s.LastHint[4 : 4+hintLen] // without the length prefix
 						s.LastHint = s.LastHint[4+hintLen:]
+						if inst.tracer != nil {
+							inst.tracer.OnHint(hint)
+						}
 						inst.preimageOracle.Hint(hint)
 					} else {
 						break // stop processing hints if there is incomplete data buffered
@@ -531,7 +601,7 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 				// second 8 bytes: hard limit
 				storeMemUnaligned(addr, toU64(16), or(shortToU256(1024), shl(toU256(64), shortToU256(1024))), 1, 2, true, true)
 			default:
-				revertWithCode(0xf0012, fmt.Errorf("unrecognized resource limit lookup: %d", res))
+				failSyscall(0xf0012, fmt.Errorf("unrecognized resource limit lookup: %d", res))
 			}
 		case 233: // madvise - ignored
 			setRegister(toU64(10), toU64(0))
@@ -561,13 +631,16 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 			setRegister(toU64(10), toU64(0))
 			setRegister(toU64(11), toU64(0))
 		case 261: // prlimit64 -- unsupported, we have getrlimit, is prlimit64 even called?
-			revertWithCode(0xf001ca11, fmt.Errorf("unsupported system call: %d", a7))
+			failSyscall(0xf001ca11, fmt.Errorf("unsupported system call: %d", a7))
 		case 422: // futex - not supported, for now
-			revertWithCode(0xf001ca11, fmt.Errorf("unsupported system call: %d", a7))
+			failSyscall(0xf001ca11, fmt.Errorf("unsupported system call: %d", a7))
 		case 101: // nanosleep - not supported, for now
-			revertWithCode(0xf001ca11, fmt.Errorf("unsupported system call: %d", a7))
+			failSyscall(0xf001ca11, fmt.Errorf("unsupported system call: %d", a7))
 		default:
-			revertWithCode(0xf001ca11, fmt.Errorf("unrecognized system call: %d", a7))
+			failSyscall(0xf001ca11, fmt.Errorf("unrecognized system call: %d", a7))
+		}
+		if inst.tracer != nil {
+			inst.syscallExit()
 		}
 	}
 
@@ -582,6 +655,9 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 
 	pc := getPC()
 	instr := loadMem(pc, toU64(4), false, 0, 0xff) // raw instruction
+	if inst.tracer != nil {
+		inst.tracer.OnInstruction(s.Step-1, pc, uint32(instr))
+	}
 
 	// these fields are ignored if not applicable to the instruction type / opcode
 	opcode := parseOpcode(instr)
@@ -591,6 +667,10 @@ func (inst *InstrumentedState) riscvStep() (outErr error) {
 	rs2 := parseRs2(instr) // source register 2 index
 	funct7 := parseFunct7(instr)
 
+	if inst.counters != nil {
+		inst.counters.countInstr(opcode, funct3, funct7)
+	}
+
 	switch opcode {
 	case 0x03: // 000_0011: memory loading
 		// LB, LH, LW, LD, LBU, LHU, LWU
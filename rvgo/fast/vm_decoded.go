@@ -0,0 +1,243 @@
+package fast
+
+import "encoding/binary"
+
+// decodedInstrAt returns the predecoded instruction at the given PC,
+// or false if the instruction cannot be served from the decode cache.
+func (m *InstrumentedState) decodedInstrAt(pc U64) (*decodedInstr, bool) {
+	if pc&3 != 0 { // instructions are only cached at 4-byte alignment
+		return nil, false
+	}
+	mem := m.state.Memory
+	p, ok := mem.pageLookup(pc >> PageAddrSize)
+	if !ok {
+		return nil, false
+	}
+	i := (pc & PageAddrMask) >> 2
+	if p.decoded == nil || !p.decoded.ok[i] {
+		// filling the decode cache modifies the page
+		p = mem.writablePage(pc>>PageAddrSize, p)
+	}
+	if p.decoded == nil {
+		p.decoded = new(decodedPage)
+	}
+	if !p.decoded.ok[i] {
+		instr := binary.LittleEndian.Uint32(p.Data[i<<2 : (i<<2)+4])
+		p.decoded.instrs[i] = decodeInstr(U64(instr))
+		p.decoded.ok[i] = true
+	}
+	return &p.decoded.instrs[i], true
+}
+
+// decodedStep runs a single instruction, like riscvStep, but dispatches on the predecoded instruction.
+// Instructions that are not predecoded are executed with riscvStep.
+// This does not support proof generation.
+func (m *InstrumentedState) decodedStep() error {
+	s := m.state
+	if s.Exited {
+		return nil
+	}
+	pc := s.PC
+	d, ok := m.decodedInstrAt(pc)
+	if !ok || d.op == opFallback {
+		return m.riscvStep()
+	}
+	s.Step += 1
+
+	regs := &s.Registers
+	rs1Value := regs[d.rs1]
+	rs2Value := regs[d.rs2]
+	var rdValue U64
+	nextPC := pc + 4
+
+	switch d.op {
+	case opNop:
+		s.PC = nextPC
+		return nil
+	case opLoad:
+		addr := rs1Value + d.imm
+		var v [8]byte
+		s.Memory.GetUnaligned(addr, v[:d.size])
+		rdValue = binary.LittleEndian.Uint64(v[:])
+		bitSize := U64(d.size) << 3
+		if d.signed && rdValue&(1<<(bitSize-1)) != 0 {
+			rdValue |= 0xFFFF_FFFF_FFFF_FFFF << bitSize
+		}
+	case opStore:
+		addr := rs1Value + d.imm
+		var bytez [8]byte
+		binary.LittleEndian.PutUint64(bytez[:], rs2Value)
+		size := U64(d.size)
+		leftAddr := addr &^ 31
+		if (addr+size-1)&^31 == leftAddr {
+			s.Memory.SetUnaligned(addr, bytez[:size])
+		} else {
+			// split the write at the 32-byte leaf boundary, like storeMem does
+			rightAddr := leftAddr + 32
+			leftSize := rightAddr - addr
+			s.Memory.SetUnaligned(addr, bytez[:leftSize])
+			s.Memory.SetUnaligned(rightAddr, bytez[leftSize:size])
+		}
+		s.PC = nextPC
+		return nil
+	case opBranch:
+		var branchHit bool
+		switch d.funct3 {
+		case 0: // BEQ
+			branchHit = rs1Value == rs2Value
+		case 1: // BNE
+			branchHit = rs1Value != rs2Value
+		case 4: // BLT
+			branchHit = int64(rs1Value) < int64(rs2Value)
+		case 5: // BGE
+			branchHit = int64(rs1Value) >= int64(rs2Value)
+		case 6: // BLTU
+			branchHit = rs1Value < rs2Value
+		case 7: // BGEU
+			branchHit = rs1Value >= rs2Value
+		}
+		if branchHit {
+			s.PC = pc + d.imm
+		} else {
+			s.PC = nextPC
+		}
+		return nil
+
+	case opADDI:
+		rdValue = rs1Value + d.imm
+	case opSLLI:
+		rdValue = rs1Value << d.imm
+	case opSLTI:
+		rdValue = slt64(rs1Value, d.imm)
+	case opSLTIU:
+		rdValue = lt64(rs1Value, d.imm)
+	case opXORI:
+		rdValue = rs1Value ^ d.imm
+	case opSRLI:
+		rdValue = rs1Value >> d.imm
+	case opSRAI:
+		rdValue = sar64(d.imm, rs1Value)
+	case opORI:
+		rdValue = rs1Value | d.imm
+	case opANDI:
+		rdValue = rs1Value & d.imm
+
+	case opADDIW:
+		rdValue = mask32Signed64(rs1Value + d.imm)
+	case opSLLIW:
+		rdValue = mask32Signed64(rs1Value << d.imm)
+	case opSRLIW:
+		rdValue = signExtend64((rs1Value&u32Mask())>>d.imm, toU64(31))
+	case opSRAIW:
+		rdValue = signExtend64((rs1Value&u32Mask())>>d.imm, toU64(31)-d.imm)
+
+	case opADD:
+		rdValue = rs1Value + rs2Value
+	case opSUB:
+		rdValue = rs1Value - rs2Value
+	case opSLL:
+		rdValue = rs1Value << (rs2Value & 0x3F)
+	case opSLT:
+		rdValue = slt64(rs1Value, rs2Value)
+	case opSLTU:
+		rdValue = lt64(rs1Value, rs2Value)
+	case opXOR:
+		rdValue = rs1Value ^ rs2Value
+	case opSRL:
+		rdValue = rs1Value >> (rs2Value & 0x3F)
+	case opSRA:
+		rdValue = sar64(rs2Value&0x3F, rs1Value)
+	case opOR:
+		rdValue = rs1Value | rs2Value
+	case opAND:
+		rdValue = rs1Value & rs2Value
+
+	case opMUL:
+		rdValue = rs1Value * rs2Value
+	case opMULH:
+		rdValue = u256ToU64(shr(toU256(64), mul(signExtend64To256(rs1Value), signExtend64To256(rs2Value))))
+	case opMULHSU:
+		rdValue = u256ToU64(shr(toU256(64), mul(signExtend64To256(rs1Value), u64ToU256(rs2Value))))
+	case opMULHU:
+		rdValue = u256ToU64(shr(toU256(64), mul(u64ToU256(rs1Value), u64ToU256(rs2Value))))
+	case opDIV:
+		if rs2Value == 0 {
+			rdValue = u64Mask()
+		} else {
+			rdValue = sdiv64(rs1Value, rs2Value)
+		}
+	case opDIVU:
+		if rs2Value == 0 {
+			rdValue = u64Mask()
+		} else {
+			rdValue = div64(rs1Value, rs2Value)
+		}
+	case opREM:
+		if rs2Value == 0 {
+			rdValue = rs1Value
+		} else {
+			rdValue = smod64(rs1Value, rs2Value)
+		}
+	case opREMU:
+		if rs2Value == 0 {
+			rdValue = rs1Value
+		} else {
+			rdValue = mod64(rs1Value, rs2Value)
+		}
+
+	case opADDW:
+		rdValue = mask32Signed64((rs1Value & u32Mask()) + (rs2Value & u32Mask()))
+	case opSUBW:
+		rdValue = mask32Signed64((rs1Value & u32Mask()) - (rs2Value & u32Mask()))
+	case opSLLW:
+		rdValue = mask32Signed64(rs1Value << (rs2Value & 0x1F))
+	case opSRLW:
+		rdValue = signExtend64((rs1Value&u32Mask())>>(rs2Value&0x1F), toU64(31))
+	case opSRAW:
+		shamt := rs2Value & 0x1F
+		rdValue = signExtend64((rs1Value&u32Mask())>>shamt, toU64(31)-shamt)
+
+	case opMULW:
+		rdValue = mask32Signed64((rs1Value & u32Mask()) * (rs2Value & u32Mask()))
+	case opDIVW:
+		if rs2Value == 0 {
+			rdValue = u64Mask()
+		} else {
+			rdValue = mask32Signed64(sdiv64(mask32Signed64(rs1Value), mask32Signed64(rs2Value)))
+		}
+	case opDIVUW:
+		if rs2Value == 0 {
+			rdValue = u64Mask()
+		} else {
+			rdValue = mask32Signed64(div64(rs1Value&u32Mask(), rs2Value&u32Mask()))
+		}
+	case opREMW:
+		if rs2Value == 0 {
+			rdValue = mask32Signed64(rs1Value)
+		} else {
+			rdValue = mask32Signed64(smod64(mask32Signed64(rs1Value), mask32Signed64(rs2Value)))
+		}
+	case opREMUW:
+		if rs2Value == 0 {
+			rdValue = mask32Signed64(rs1Value)
+		} else {
+			rdValue = mask32Signed64(mod64(rs1Value&u32Mask(), rs2Value&u32Mask()))
+		}
+
+	case opLUI:
+		rdValue = d.imm
+	case opAUIPC:
+		rdValue = pc + d.imm
+	case opJAL:
+		rdValue = nextPC
+		nextPC = pc + d.imm
+	case opJALR:
+		rdValue = nextPC
+		nextPC = (rs1Value + d.imm) &^ 1
+	}
+	if d.rd != 0 { // reg 0 must stay 0
+		regs[d.rd] = rdValue
+	}
+	s.PC = nextPC
+	return nil
+}
@@ -0,0 +1,117 @@
+package fast
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodedStep(t *testing.T) {
+	rng := rand.New(rand.NewSource(1234))
+	for i := 0; i < 5_000; i++ {
+		var regs [32]uint64
+		for j := 1; j < 32; j++ {
+			switch rng.Intn(4) {
+			case 0:
+				regs[j] = uint64(rng.Intn(64)) // small values, e.g. shift amounts
+			case 1:
+				regs[j] = 0x1000 + uint64(rng.Intn(0x3000)) // addresses around the code
+			default:
+				regs[j] = rng.Uint64()
+			}
+		}
+		instr := rng.Uint32()
+		if rng.Intn(8) != 0 { // mostly pick opcodes that are predecoded
+			opcodes := []uint32{0x03, 0x23, 0x63, 0x13, 0x1B, 0x33, 0x3B, 0x37, 0x17, 0x6F, 0x67, 0x0F}
+			instr = instr&^0x7F | opcodes[rng.Intn(len(opcodes))]
+		}
+		pc := uint64(0x2000) + uint64(rng.Intn(PageSize/4))*4
+
+		newState := func() *VMState {
+			s := NewVMState()
+			s.PC = pc
+			s.Registers = regs
+			var dat [4]byte
+			binary.LittleEndian.PutUint32(dat[:], instr)
+			s.Memory.SetUnaligned(pc, dat[:])
+			return s
+		}
+		refState := newState()
+		state := newState()
+		ref := NewInstrumentedState(refState, nil, nil, nil)
+		inst := NewInstrumentedState(state, nil, nil, nil)
+		inst.SetDecodeCache(true)
+
+		_, refErr := ref.Step(false)
+		_, err := inst.Step(false)
+		if refErr != nil {
+			require.Error(t, err, "instr %08x must fail like the reference", instr)
+			continue
+		}
+		require.NoError(t, err, "instr %08x", instr)
+		require.Equal(t, refState.EncodeWitness(), state.EncodeWitness(), "instr %08x must execute the same", instr)
+	}
+}
+
+func TestDecodeCacheInvalidation(t *testing.T) {
+	state := NewVMState()
+	state.PC = 0x1000
+	addi := func(imm uint32) []byte { // addi a0, a0, imm
+		var dat [4]byte
+		binary.LittleEndian.PutUint32(dat[:], imm<<20|10<<15|10<<7|0x13)
+		return dat[:]
+	}
+	state.Memory.SetUnaligned(0x1000, addi(1))
+	inst := NewInstrumentedState(state, nil, nil, nil)
+	inst.SetDecodeCache(true)
+
+	_, err := inst.Step(false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), state.Registers[10])
+
+	// overwrite the instruction, the cached decoding must not be used anymore
+	state.Memory.SetUnaligned(0x1000, addi(5))
+	state.PC = 0x1000
+	_, err = inst.Step(false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), state.Registers[10])
+}
+
+func TestRunUntil(t *testing.T) {
+	// a0 += 1, and jump back: an endless loop
+	program := []uint32{
+		1<<20 | 10<<15 | 10<<7 | 0x13, // addi a0, a0, 1
+		0xffdff06f,                    // jal zero, -4
+	}
+	state := newTestState(program)
+	inst := NewInstrumentedState(state, nil, nil, nil)
+	require.ErrorContains(t, inst.RunUntil(context.Background(), nil), "requires the decode cache")
+	require.Zero(t, state.Step)
+	inst.SetDecodeCache(true)
+	stopAt := uint64(0)
+	stopFn := func(state *VMState) bool {
+		return state.Step >= stopAt
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		stopAt += 1000
+		require.NoError(t, inst.RunUntil(context.Background(), stopFn))
+	})
+	require.Zero(t, allocs, "no allocations in the hot loop")
+	require.Equal(t, uint64(11_000), state.Step)
+	require.Equal(t, uint64(5_500), state.Registers[10])
+
+	refState := newTestState(program)
+	ref := NewInstrumentedState(refState, nil, nil, nil)
+	for refState.Step < state.Step {
+		_, err := ref.Step(false)
+		require.NoError(t, err)
+	}
+	require.Equal(t, refState.EncodeWitness(), state.EncodeWitness())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, inst.RunUntil(ctx, nil), context.Canceled)
+}
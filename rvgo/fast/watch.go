@@ -0,0 +1,94 @@
+package fast
+
+// Watchpoint is a range of guest memory to watch the loads and/or stores of.
+type Watchpoint struct {
+	Addr uint64 `json:"addr"`
+	Len  uint64 `json:"len"`
+
+	Read  bool `json:"read"`
+	Write bool `json:"write"`
+}
+
+// overlaps returns true if the memory range of size bytes at addr overlaps with the watched range.
+// The ranges are compared by their offsets to each other, which do not overflow at the end of the address space.
+func (w *Watchpoint) overlaps(addr, size uint64) bool {
+	if addr >= w.Addr {
+		return addr-w.Addr < w.Len
+	}
+	return w.Addr-addr < size
+}
+
+// WatchHit is a guest memory access that touched a watchpoint.
+type WatchHit struct {
+	Watchpoint Watchpoint `json:"watchpoint"`
+
+	// Step and PC of the instruction that accessed the memory
+	Step uint64 `json:"step"`
+	PC   uint64 `json:"pc"`
+
+	Addr  uint64 `json:"addr"`
+	Write bool   `json:"write"`
+	// Data is the data that was loaded, or the data that was stored.
+	Data []byte `json:"data"`
+}
+
+// SetWatchpoints sets the memory ranges to watch the guest loads and stores of, or nil to stop watching.
+// Instruction fetches are not watched. Stores include the writes of pre-image data by the read syscall.
+// Watchpoints are a tracer of the memory accesses, that runs next to the tracer of SetTracer:
+// steps with watchpoints do not use the decode cache.
+func (m *InstrumentedState) SetWatchpoints(watchpoints []Watchpoint) {
+	if len(watchpoints) == 0 {
+		m.watch = nil
+	} else {
+		m.watch = &watchTracer{state: m.state, watchpoints: watchpoints}
+	}
+	m.updateTracer()
+}
+
+// WatchHits returns the watched memory accesses of the last step, in order of access.
+// The returned hits are only valid until the next step.
+func (m *InstrumentedState) WatchHits() []WatchHit {
+	if m.watch == nil {
+		return nil
+	}
+	return m.watch.hits
+}
+
+// watchTracer records the guest memory accesses that hit watchpoints, of the last step.
+type watchTracer struct {
+	NoopTracer
+	state       *VMState
+	watchpoints []Watchpoint
+	// hits are the watched memory accesses of the last step
+	hits []WatchHit
+}
+
+func (w *watchTracer) OnInstruction(step uint64, pc uint64, instr uint32) {
+	w.hits = w.hits[:0]
+}
+
+func (w *watchTracer) OnMemoryRead(addr uint64, data []byte) {
+	w.access(addr, data, false)
+}
+
+func (w *watchTracer) OnMemoryWrite(addr uint64, data []byte) {
+	w.access(addr, data, true)
+}
+
+// access records a hit of every watchpoint that the memory access overlaps with.
+// The step counter of the state is already incremented when memory is accessed.
+func (w *watchTracer) access(addr uint64, data []byte, write bool) {
+	for _, wp := range w.watchpoints {
+		if (write && !wp.Write) || (!write && !wp.Read) || !wp.overlaps(addr, uint64(len(data))) {
+			continue
+		}
+		w.hits = append(w.hits, WatchHit{
+			Watchpoint: wp,
+			Step:       w.state.Step - 1,
+			PC:         w.state.PC,
+			Addr:       addr,
+			Write:      write,
+			Data:       append([]byte(nil), data...),
+		})
+	}
+}
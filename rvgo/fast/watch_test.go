@@ -0,0 +1,84 @@
+package fast
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchpoints(t *testing.T) {
+	// a program that stores an incrementing counter to memory, loads it back, and exits when it reaches 5
+	program := []uint32{
+		1<<20 | 10<<15 | 10<<7 | 0x13,  // addi a0, a0, 1
+		10<<20 | 11<<15 | 3<<12 | 0x23, // sd a0, 0(a1)
+		11<<15 | 3<<12 | 13<<7 | 0x03,  // ld a3, 0(a1)
+		0xfec6cae3,                     // blt a3, a2, -12
+		0x5d00893,                      // addi a7, zero, 93
+		0x73,                           // ecall
+	}
+	state := newTestState(program)
+	state.Registers[11] = 0x8004
+	state.Registers[12] = 5
+	refState := state.Clone()
+
+	us := NewInstrumentedState(state, nil, nil, nil)
+	us.SetDecodeCache(true)
+	writes := Watchpoint{Addr: 0x8008, Len: 4, Write: true}
+	reads := Watchpoint{Addr: 0x8000, Len: 8, Read: true}
+	code := Watchpoint{Addr: 0x1000, Len: 0x100, Read: true, Write: true}
+	us.SetWatchpoints([]Watchpoint{writes, reads, code})
+	tr := &testTracer{}
+	us.SetTracer(tr) // runs next to the watchpoints
+
+	var hits []WatchHit
+	sawExit := false
+	require.NoError(t, us.RunUntil(context.Background(), func(state *VMState) bool {
+		hits = append(hits, us.WatchHits()...)
+		sawExit = sawExit || state.Exited
+		return false
+	}))
+	require.True(t, state.Exited)
+	require.True(t, sawExit, "the stop function sees the hits of the final step")
+	require.Len(t, hits, 10, "a store and a load per iteration, and no instruction fetches")
+	require.Equal(t, WatchHit{
+		Watchpoint: writes,
+		Step:       1,
+		PC:         0x1004,
+		Addr:       0x8004,
+		Write:      true,
+		Data:       []byte{1, 0, 0, 0, 0, 0, 0, 0},
+	}, hits[0])
+	require.Equal(t, WatchHit{
+		Watchpoint: reads,
+		Step:       2,
+		PC:         0x1008,
+		Addr:       0x8004,
+		Data:       []byte{1, 0, 0, 0, 0, 0, 0, 0},
+	}, hits[1])
+	require.Equal(t, uint64(4*4+2), hits[9].Step, "load of the last iteration")
+	require.Equal(t, []byte{5, 0, 0, 0, 0, 0, 0, 0}, hits[9].Data)
+	require.Len(t, tr.writes, 5, "the tracer sees the stores")
+	require.Len(t, tr.reads, 5, "the tracer sees the loads")
+
+	ref := NewInstrumentedState(refState, nil, nil, nil)
+	ref.SetDecodeCache(true)
+	require.NoError(t, ref.RunUntil(context.Background(), nil))
+	require.Equal(t, refState.EncodeWitness(), state.EncodeWitness(), "watchpoints do not change execution")
+}
+
+func TestWatchpointOverlaps(t *testing.T) {
+	w := Watchpoint{Addr: 0x100, Len: 8}
+	require.False(t, w.overlaps(0xf8, 8))
+	require.True(t, w.overlaps(0xf9, 8))
+	require.True(t, w.overlaps(0x104, 1))
+	require.True(t, w.overlaps(0x107, 8))
+	require.False(t, w.overlaps(0x108, 8))
+	require.True(t, w.overlaps(0, 0x200), "contains the watchpoint")
+
+	end := Watchpoint{Addr: ^uint64(0) - 3, Len: 4}
+	require.True(t, end.overlaps(^uint64(0), 1), "watchpoint at the end of the address space")
+	require.True(t, end.overlaps(^uint64(0)-7, 8))
+	require.False(t, end.overlaps(0, 8), "does not wrap around")
+	require.False(t, w.overlaps(^uint64(0)-3, 8), "access that wraps around is not at the start of the address space")
+}
@@ -21,6 +21,11 @@ func main() {
 		cmd.LoadELFCommand,
 		cmd.WitnessCommand,
 		cmd.RunCommand,
+		cmd.BenchCommand,
+		cmd.ConvertCommand,
+		cmd.ProveCommand,
+		cmd.CoverageCommand,
+		cmd.CountersCommand,
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 
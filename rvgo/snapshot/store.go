@@ -0,0 +1,141 @@
+// Package snapshot manages a directory of VM state snapshots, indexed by step.
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Retention is the policy of which snapshots to keep, when a new snapshot is added to the store.
+// A snapshot is kept if any of the rules applies to it. The latest snapshot is always kept.
+// The zero value keeps all snapshots.
+type Retention struct {
+	// KeepEvery keeps the snapshots at steps that are a multiple of KeepEvery. 0 disables the rule.
+	KeepEvery uint64
+	// KeepLast keeps the latest KeepLast snapshots. 0 disables the rule.
+	KeepLast int
+}
+
+// KeepsAll returns true if the policy never removes snapshots.
+func (r Retention) KeepsAll() bool {
+	return r.KeepEvery == 0 && r.KeepLast == 0
+}
+
+// Store is a directory of snapshots, with file names formatted from the step of the snapshot.
+// The store does not read or write the snapshots themselves: it only tracks and prunes the files.
+// The store is safe for concurrent use.
+type Store struct {
+	dir       string
+	nameFmt   string
+	retention Retention
+
+	mu sync.Mutex
+	// sorted steps of the snapshots in the store
+	steps []uint64
+}
+
+// OpenStore opens the snapshot store in the given directory, creating the directory if it does not exist.
+// The file names of the snapshots are formatted with nameFmt and the step, e.g. "state-%d.bin.gz".
+// Files in the directory that do not match the name format are ignored.
+func OpenStore(dir string, nameFmt string, retention Retention) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot dir: %w", err)
+	}
+	s := &Store{dir: dir, nameFmt: nameFmt, retention: retention}
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+		var step uint64
+		if _, err := fmt.Sscanf(item.Name(), nameFmt, &step); err != nil {
+			continue
+		}
+		if fmt.Sprintf(nameFmt, step) != item.Name() { // e.g. trailing data, or leading zeroes
+			continue
+		}
+		s.steps = append(s.steps, step)
+	}
+	sort.Slice(s.steps, func(i, j int) bool {
+		return s.steps[i] < s.steps[j]
+	})
+	return s, nil
+}
+
+// Path returns the path of the snapshot at the given step, whether it exists or not.
+func (s *Store) Path(step uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf(s.nameFmt, step))
+}
+
+// Steps returns the sorted steps of the snapshots in the store.
+func (s *Store) Steps() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint64(nil), s.steps...)
+}
+
+// Nearest returns the step of the latest snapshot at or before the given step, if any.
+func (s *Store) Nearest(step uint64) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := sort.Search(len(s.steps), func(i int) bool { return s.steps[i] > step })
+	if n == 0 {
+		return 0, false
+	}
+	return s.steps[n-1], true
+}
+
+// Latest returns the step of the latest snapshot, if any.
+func (s *Store) Latest() (uint64, bool) {
+	return s.Nearest(^uint64(0))
+}
+
+// Has returns true if there is a snapshot at the given step.
+func (s *Store) Has(step uint64) bool {
+	nearest, ok := s.Nearest(step)
+	return ok && nearest == step
+}
+
+// Add registers the snapshot at the given step, after it is written to Path(step),
+// and removes the snapshots that the retention policy does not keep.
+func (s *Store) Add(step uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := sort.Search(len(s.steps), func(i int) bool { return s.steps[i] >= step })
+	if n == len(s.steps) || s.steps[n] != step {
+		s.steps = append(s.steps, 0)
+		copy(s.steps[n+1:], s.steps[n:])
+		s.steps[n] = step
+	}
+	return s.prune()
+}
+
+func (s *Store) prune() error {
+	if s.retention.KeepsAll() {
+		return nil
+	}
+	kept := s.steps[:0]
+	var errs []error
+	for i, step := range s.steps {
+		fromEnd := len(s.steps) - i
+		if fromEnd == 1 ||
+			(s.retention.KeepLast != 0 && fromEnd <= s.retention.KeepLast) ||
+			(s.retention.KeepEvery != 0 && step%s.retention.KeepEvery == 0) {
+			kept = append(kept, step)
+			continue
+		}
+		if err := os.Remove(s.Path(step)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to remove snapshot at step %d: %w", step, err))
+			kept = append(kept, step)
+		}
+	}
+	s.steps = kept
+	return errors.Join(errs...)
+}
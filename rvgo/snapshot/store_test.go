@@ -0,0 +1,66 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"state-10.json", "state-30.json", "state-20.json", "state-05.json", "state-7.json.tmp", "other.json"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644))
+	}
+	s, err := OpenStore(dir, "state-%d.json", Retention{})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{10, 20, 30}, s.Steps(), "only files that match the name format")
+
+	step, ok := s.Nearest(25)
+	require.True(t, ok)
+	require.Equal(t, uint64(20), step)
+	step, ok = s.Nearest(20)
+	require.True(t, ok)
+	require.Equal(t, uint64(20), step)
+	_, ok = s.Nearest(9)
+	require.False(t, ok)
+	step, ok = s.Latest()
+	require.True(t, ok)
+	require.Equal(t, uint64(30), step)
+	require.True(t, s.Has(10))
+	require.False(t, s.Has(11))
+	require.Equal(t, filepath.Join(dir, "state-15.json"), s.Path(15))
+
+	require.NoError(t, s.Add(15))
+	require.Equal(t, []uint64{10, 15, 20, 30}, s.Steps())
+	require.NoError(t, s.Add(15))
+	require.Equal(t, []uint64{10, 15, 20, 30}, s.Steps(), "no duplicates")
+}
+
+func TestStoreRetention(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(dir, "%d.bin", Retention{KeepEvery: 100, KeepLast: 2})
+	require.NoError(t, err)
+	for step := uint64(0); step <= 350; step += 25 {
+		require.NoError(t, os.WriteFile(s.Path(step), nil, 0644))
+		require.NoError(t, s.Add(step))
+	}
+	expected := []uint64{0, 100, 200, 300, 325, 350}
+	require.Equal(t, expected, s.Steps())
+
+	// the files of pruned snapshots are removed
+	reopened, err := OpenStore(dir, "%d.bin", Retention{})
+	require.NoError(t, err)
+	require.Equal(t, expected, reopened.Steps())
+
+	t.Run("latest", func(t *testing.T) {
+		s, err := OpenStore(t.TempDir(), "%d.bin", Retention{KeepEvery: 1000})
+		require.NoError(t, err)
+		for _, step := range []uint64{1000, 1500, 1700} {
+			require.NoError(t, os.WriteFile(s.Path(step), nil, 0644))
+			require.NoError(t, s.Add(step))
+		}
+		require.Equal(t, []uint64{1000, 1700}, s.Steps(), "latest snapshot is always kept")
+	})
+}
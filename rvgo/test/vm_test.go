@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"debug/elf"
 	"os"
 	"path/filepath"
@@ -58,6 +59,75 @@ func runFastTestSuite(t *testing.T, path string) {
 	}
 }
 
+func runFastDecodedTestSuite(t *testing.T, path string) {
+	testSuiteELF, err := elf.Open(path)
+	require.NoError(t, err)
+	defer testSuiteELF.Close()
+
+	vmState, err := fast.LoadELF(testSuiteELF)
+	require.NoError(t, err, "must load test suite ELF binary")
+	refState, err := fast.LoadELF(testSuiteELF)
+	require.NoError(t, err, "must load test suite ELF binary")
+
+	inState := fast.NewInstrumentedState(vmState, nil, os.Stdout, os.Stderr)
+	inState.SetDecodeCache(true)
+	refInState := fast.NewInstrumentedState(refState, nil, os.Stdout, os.Stderr)
+
+	for i := 0; i < 10_000; i++ {
+		if _, err := inState.Step(false); err != nil {
+			t.Fatalf("VM err at step %d, PC %x: %v", i, vmState.PC, err)
+		}
+		_, err := refInState.Step(false)
+		require.NoError(t, err)
+		require.Equal(t, refState.EncodeWitness(), vmState.EncodeWitness(), "decoded execution must match at step %d", i)
+		if vmState.Exited {
+			break
+		}
+	}
+	require.True(t, vmState.Exited, "ran out of steps")
+	if vmState.ExitCode != 0 {
+		testCaseNum := vmState.ExitCode >> 1
+		t.Fatalf("failed at test case %d", testCaseNum)
+	}
+}
+
+func runFastRunUntilTestSuite(t *testing.T, path string) {
+	testSuiteELF, err := elf.Open(path)
+	require.NoError(t, err)
+	defer testSuiteELF.Close()
+
+	vmState, err := fast.LoadELF(testSuiteELF)
+	require.NoError(t, err, "must load test suite ELF binary")
+	refState, err := fast.LoadELF(testSuiteELF)
+	require.NoError(t, err, "must load test suite ELF binary")
+
+	inState := fast.NewInstrumentedState(vmState, nil, os.Stdout, os.Stderr)
+	inState.SetDecodeCache(true)
+	refInState := fast.NewInstrumentedState(refState, nil, os.Stdout, os.Stderr)
+
+	// stop at irregular intervals, to compare intermediate states
+	const interval = 37
+	for i := 0; i < 10_000; i += interval {
+		err := inState.RunUntil(context.Background(), func(state *fast.VMState) bool {
+			return state.Step >= refState.Step+interval
+		})
+		require.NoError(t, err, "VM err at PC %x", vmState.PC)
+		for j := 0; j < interval && !refState.Exited; j++ {
+			_, err := refInState.Step(false)
+			require.NoError(t, err)
+		}
+		require.Equal(t, refState.EncodeWitness(), vmState.EncodeWitness(), "RunUntil must match Step at step %d", refState.Step)
+		if vmState.Exited {
+			break
+		}
+	}
+	require.True(t, vmState.Exited, "ran out of steps")
+	if vmState.ExitCode != 0 {
+		testCaseNum := vmState.ExitCode >> 1
+		t.Fatalf("failed at test case %d", testCaseNum)
+	}
+}
+
 func runSlowTestSuite(t *testing.T, path string) {
 	testSuiteELF, err := elf.Open(path)
 	require.NoError(t, err)
@@ -160,6 +230,30 @@ func TestFastStep(t *testing.T) {
 	//runTestCategory("benchmarks")  TODO benchmarks (fix ELF bench data loading and wrap in Go benchmark?)
 }
 
+func TestFastDecodedStep(t *testing.T) {
+	testsPath := filepath.FromSlash("../tests/riscv-tests")
+	runTestCategory := func(name string) {
+		t.Run(name, func(t *testing.T) {
+			forEachTestSuite(t, filepath.Join(testsPath, name), runFastDecodedTestSuite)
+		})
+	}
+	runTestCategory("rv64ui-p")
+	runTestCategory("rv64um-p")
+	runTestCategory("rv64ua-p")
+}
+
+func TestFastRunUntil(t *testing.T) {
+	testsPath := filepath.FromSlash("../tests/riscv-tests")
+	runTestCategory := func(name string) {
+		t.Run(name, func(t *testing.T) {
+			forEachTestSuite(t, filepath.Join(testsPath, name), runFastRunUntilTestSuite)
+		})
+	}
+	runTestCategory("rv64ui-p")
+	runTestCategory("rv64um-p")
+	runTestCategory("rv64ua-p")
+}
+
 func TestSlowStep(t *testing.T) {
 	testsPath := filepath.FromSlash("../tests/riscv-tests")
 	runTestCategory := func(name string) {
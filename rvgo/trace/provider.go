@@ -0,0 +1,342 @@
+// Package trace provides the execution trace of an Asterisc program, as needed by a fault dispute game:
+// the state hash after each step, and the data to execute a step onchain.
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/lru"
+	"github.com/ethereum/go-ethereum/log"
+
+	preimage "github.com/ethereum-optimism/optimism/op-preimage"
+	"github.com/ethereum-optimism/optimism/op-service/ioutil"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+	"github.com/ethereum-optimism/asterisc/rvgo/snapshot"
+)
+
+const (
+	snapshotsDir = "snapshots"
+	proofsDir    = "proofs"
+)
+
+// proofData is the proof of a single step, stored in the proofs directory.
+// It uses the same encoding as the proofs written by asterisc run.
+type proofData struct {
+	Step uint64 `json:"step"`
+
+	Pre  common.Hash `json:"pre"`
+	Post common.Hash `json:"post"`
+
+	StateData hexutil.Bytes `json:"state-data"`
+	ProofData hexutil.Bytes `json:"proof-data"`
+
+	OracleKey    hexutil.Bytes `json:"oracle-key,omitempty"`
+	OracleValue  hexutil.Bytes `json:"oracle-value,omitempty"`
+	OracleOffset uint64        `json:"oracle-offset,omitempty"`
+}
+
+// PreimageOracleData is the pre-image data that has to be loaded into the onchain pre-image oracle,
+// before a step that reads it can be executed.
+type PreimageOracleData struct {
+	IsLocal      bool
+	OracleKey    []byte
+	OracleValue  []byte // including the 8-byte length prefix
+	OracleOffset uint64
+}
+
+type Config struct {
+	// Dir is the directory to store snapshots and proofs in. It is created if it does not exist.
+	Dir string
+	// SnapshotInterval is the number of steps between snapshots, written while running forward.
+	// Snapshots are the checkpoints to run from, when an earlier step is requested. 0 disables snapshots.
+	SnapshotInterval uint64
+	// CacheSize is the number of proofs to keep in memory.
+	CacheSize int
+	// StdOut and StdErr receive the output of the program, and may be nil.
+	StdOut io.Writer
+	StdErr io.Writer
+}
+
+// Provider is an execution-trace provider over the fast VM.
+// The trace at index i is the state after executing step i, starting from the absolute pre-state.
+// Traces past the exit of the program are extended with the exited state.
+// Proofs are generated on demand, by running forward from the nearest snapshot, and are cached on disk and in memory.
+// The provider is safe for concurrent use, but requests are served one at a time.
+type Provider struct {
+	logger log.Logger
+	cfg    Config
+	oracle fast.PreimageOracle
+
+	mu sync.Mutex
+
+	prestate *fast.VMState
+
+	// state is the current position of the VM, run forward on demand
+	state *fast.VMState
+	us    *fast.InstrumentedState
+
+	snapshots *snapshot.Store
+
+	proofs lru.BasicLRU[uint64, *proofData]
+
+	// lastStep is the last step that is executed in the trace, if lastStepKnown is true
+	lastStep      uint64
+	lastStepKnown bool
+}
+
+// NewProvider creates a trace provider for the execution from the given absolute pre-state.
+// The pre-image oracle serves the pre-images the program requests, for any step.
+func NewProvider(logger log.Logger, prestate *fast.VMState, oracle fast.PreimageOracle, cfg Config) (*Provider, error) {
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, proofsDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create proofs dir: %w", err)
+	}
+	snapshots, err := snapshot.OpenStore(filepath.Join(cfg.Dir, snapshotsDir), "%d.bin.gz", snapshot.Retention{})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 1
+	}
+	if cfg.StdOut == nil {
+		cfg.StdOut = io.Discard
+	}
+	if cfg.StdErr == nil {
+		cfg.StdErr = io.Discard
+	}
+	return &Provider{
+		logger:    logger,
+		cfg:       cfg,
+		oracle:    oracle,
+		prestate:  prestate.Clone(),
+		snapshots: snapshots,
+		proofs:    lru.NewBasicLRU[uint64, *proofData](cfg.CacheSize),
+	}, nil
+}
+
+// AbsolutePreState returns the encoded state witness of the absolute pre-state.
+func (p *Provider) AbsolutePreState(ctx context.Context) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.prestate.EncodeWitness(), nil
+}
+
+// AbsolutePreStateCommitment returns the state hash of the absolute pre-state.
+func (p *Provider) AbsolutePreStateCommitment(ctx context.Context) (common.Hash, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hash, err := p.prestate.EncodeWitness().StateHash()
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("cannot hash absolute pre-state: %w", err)
+	}
+	return hash, nil
+}
+
+// Get returns the state hash after executing the step at the trace index.
+func (p *Provider) Get(ctx context.Context, traceIndex uint64) (common.Hash, error) {
+	proof, err := p.loadProof(ctx, traceIndex)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return proof.Post, nil
+}
+
+// GetStepData returns the encoded pre-state of the step at the trace index, the memory proof data to execute it,
+// and the pre-image oracle data the step reads, if any.
+func (p *Provider) GetStepData(ctx context.Context, traceIndex uint64) (prestate []byte, proofData []byte, oracleData *PreimageOracleData, err error) {
+	proof, err := p.loadProof(ctx, traceIndex)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(proof.OracleKey) > 0 {
+		oracleData = &PreimageOracleData{
+			IsLocal:      proof.OracleKey[0] == byte(preimage.LocalKeyType),
+			OracleKey:    proof.OracleKey,
+			OracleValue:  proof.OracleValue,
+			OracleOffset: proof.OracleOffset,
+		}
+	}
+	return proof.StateData, proof.ProofData, oracleData, nil
+}
+
+// loadProof loads the proof of the step at the given trace index from the cache, or generates it.
+func (p *Provider) loadProof(ctx context.Context, i uint64) (*proofData, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// past the end of the trace, the last step is repeated as no-op
+	if p.lastStepKnown && i > p.lastStep {
+		i = p.lastStep + 1
+	}
+	if proof, ok := p.proofs.Get(i); ok {
+		return proof, nil
+	}
+	path := filepath.Join(p.cfg.Dir, proofsDir, fmt.Sprintf("%d.json.gz", i))
+	if proof, err := loadProofFile(path); err == nil {
+		p.proofs.Add(i, proof)
+		return proof, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		p.logger.Warn("Failed to load cached proof, regenerating it", "step", i, "err", err)
+	}
+	proof, err := p.generateProof(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeJSON(path, proof); err != nil {
+		p.logger.Warn("Failed to write proof to disk cache", "step", i, "err", err)
+	}
+	p.proofs.Add(i, proof)
+	return proof, nil
+}
+
+// generateProof runs the VM to the given step, from the nearest snapshot, and proves the step.
+func (p *Provider) generateProof(ctx context.Context, i uint64) (*proofData, error) {
+	nearest, hasSnapshot := p.snapshots.Nearest(i)
+	if p.state == nil || p.state.Step > i || (hasSnapshot && nearest > p.state.Step) {
+		p.resetTo(nearest, hasSnapshot)
+	}
+	// run forward, writing snapshots along the way
+	for p.state.Step < i && !p.state.Exited {
+		target := i
+		if interval := p.cfg.SnapshotInterval; interval != 0 {
+			if next := (p.state.Step/interval + 1) * interval; next < target {
+				target = next
+			}
+		}
+		if err := p.us.RunUntil(ctx, func(state *fast.VMState) bool {
+			return state.Step >= target
+		}); err != nil {
+			return nil, fmt.Errorf("failed to run to step %d: %w", target, err)
+		}
+		if interval := p.cfg.SnapshotInterval; interval != 0 && p.state.Step%interval == 0 && !p.state.Exited {
+			if err := p.writeSnapshot(); err != nil {
+				p.logger.Warn("Failed to write snapshot", "step", p.state.Step, "err", err)
+			}
+		}
+	}
+
+	preStateHash, err := p.state.EncodeWitness().StateHash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash pre-state: %w", err)
+	}
+	if p.state.Exited {
+		// The final instruction has already been applied to the exited state,
+		// so the last executed step is one before its step value.
+		if p.state.Step > 0 {
+			p.lastStep = p.state.Step - 1
+			p.lastStepKnown = true
+		}
+		p.logger.Info("Requested proof after the program exited", "proof", i, "last", p.lastStep)
+		// Extend the trace with a no-op that does not change the state.
+		// There is nothing to execute, so no proof data or oracle values are required.
+		return &proofData{
+			Step:      p.state.Step,
+			Pre:       preStateHash,
+			Post:      preStateHash,
+			StateData: hexutil.Bytes(p.state.EncodeWitness()),
+			ProofData: []byte{},
+		}, nil
+	}
+	witness, err := p.us.Step(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed at proof-gen step %d (PC: %08x): %w", i, p.state.PC, err)
+	}
+	postStateHash, err := p.state.EncodeWitness().StateHash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash post-state: %w", err)
+	}
+	proof := &proofData{
+		Step:      i,
+		Pre:       preStateHash,
+		Post:      postStateHash,
+		StateData: witness.State,
+		ProofData: witness.MemProof,
+	}
+	if witness.HasPreimage() {
+		proof.OracleKey = witness.PreimageKey[:]
+		proof.OracleValue = witness.PreimageValue
+		proof.OracleOffset = witness.PreimageOffset
+	}
+	return proof, nil
+}
+
+// resetTo moves the VM to the snapshot at the given step, or the absolute pre-state if there is no snapshot.
+func (p *Provider) resetTo(step uint64, hasSnapshot bool) {
+	state := p.prestate.Clone()
+	if hasSnapshot {
+		snapshot, err := loadSnapshot(p.snapshots.Path(step))
+		if err == nil {
+			state = snapshot
+		} else {
+			p.logger.Warn("Failed to load snapshot, running from the absolute pre-state", "step", step, "err", err)
+		}
+	}
+	p.state = state
+	p.us = fast.NewInstrumentedState(state, p.oracle, p.cfg.StdOut, p.cfg.StdErr)
+	p.us.SetDecodeCache(true)
+}
+
+func (p *Provider) writeSnapshot() error {
+	step := p.state.Step
+	if p.snapshots.Has(step) {
+		return nil
+	}
+	f, err := ioutil.NewAtomicWriterCompressed(p.snapshots.Path(step), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer f.Close()
+	if err := p.state.SerializeWithMerkleCache(f); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to finish snapshot: %w", err)
+	}
+	return p.snapshots.Add(step)
+}
+
+func loadSnapshot(path string) (*fast.VMState, error) {
+	f, err := ioutil.OpenDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var state fast.VMState
+	if err := state.Deserialize(f); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q: %w", path, err)
+	}
+	return &state, nil
+}
+
+func loadProofFile(path string) (*proofData, error) {
+	f, err := ioutil.OpenDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var proof proofData
+	if err := json.NewDecoder(f).Decode(&proof); err != nil {
+		return nil, fmt.Errorf("failed to decode proof %q: %w", path, err)
+	}
+	return &proof, nil
+}
+
+func writeJSON(path string, v any) error {
+	f, err := ioutil.NewAtomicWriterCompressed(path, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,137 @@
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ethereum-optimism/asterisc/rvgo/fast"
+)
+
+// testPrestate is a program that stores an incrementing counter to memory, and exits when it reaches 50.
+func testPrestate() *fast.VMState {
+	program := []uint32{
+		1<<20 | 10<<15 | 10<<7 | 0x13,  // addi a0, a0, 1
+		10<<20 | 11<<15 | 3<<12 | 0x23, // sd a0, 0(a1)
+		0xfec54ce3,                     // blt a0, a2, -8
+		0x5d00893,                      // addi a7, zero, 93
+		0x73,                           // ecall
+	}
+	state := fast.NewVMState()
+	state.PC = 0x1000
+	for i, instr := range program {
+		var dat [4]byte
+		binary.LittleEndian.PutUint32(dat[:], instr)
+		state.Memory.SetUnaligned(0x1000+uint64(i)*4, dat[:])
+	}
+	state.Registers[11] = 0x8000
+	state.Registers[12] = 50
+	return state
+}
+
+// referenceTrace runs the program step by step, and returns the state hash and witness before every step.
+func referenceTrace(t *testing.T) (hashes []common.Hash, witnesses [][]byte) {
+	state := testPrestate()
+	us := fast.NewInstrumentedState(state, nil, nil, nil)
+	for {
+		wit := state.EncodeWitness()
+		h, err := wit.StateHash()
+		require.NoError(t, err)
+		hashes = append(hashes, h)
+		witnesses = append(witnesses, wit)
+		if state.Exited {
+			return
+		}
+		_, err = us.Step(false)
+		require.NoError(t, err)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	hashes, witnesses := referenceTrace(t)
+	exitStep := uint64(len(hashes) - 1)
+	require.Equal(t, uint64(50*3+2), exitStep)
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	newProvider := func() *Provider {
+		p, err := NewProvider(log.New(), testPrestate(), nil, Config{Dir: dir, SnapshotInterval: 40, CacheSize: 10})
+		require.NoError(t, err)
+		return p
+	}
+	p := newProvider()
+
+	pre, err := p.AbsolutePreState(ctx)
+	require.NoError(t, err)
+	require.Equal(t, witnesses[0], pre)
+	preHash, err := p.AbsolutePreStateCommitment(ctx)
+	require.NoError(t, err)
+	require.Equal(t, hashes[0], preHash)
+
+	// request out of order, to run forward and back from snapshots
+	for _, i := range []uint64{100, 5, 99, 130, 41, 0, 151} {
+		h, err := p.Get(ctx, i)
+		require.NoError(t, err)
+		require.Equal(t, hashes[i+1], h, "post-state of step %d", i)
+		state, proof, oracleData, err := p.GetStepData(ctx, i)
+		require.NoError(t, err)
+		require.Equal(t, witnesses[i], state, "pre-state of step %d", i)
+		require.NotEmpty(t, proof)
+		require.Nil(t, oracleData)
+	}
+	snapshots, err := os.ReadDir(filepath.Join(dir, snapshotsDir))
+	require.NoError(t, err)
+	require.Len(t, snapshots, 3, "snapshots at 40, 80 and 120")
+
+	// past the exit, the trace is extended with the exited state
+	for _, i := range []uint64{exitStep, exitStep + 1, 1 << 40} {
+		h, err := p.Get(ctx, i)
+		require.NoError(t, err)
+		require.Equal(t, hashes[exitStep], h)
+		state, proof, _, err := p.GetStepData(ctx, i)
+		require.NoError(t, err)
+		require.Equal(t, witnesses[exitStep], state)
+		require.Empty(t, proof)
+	}
+
+	// a new provider uses the existing snapshots and proofs
+	p = newProvider()
+	require.Equal(t, []uint64{40, 80, 120}, p.snapshots.Steps())
+	h, err := p.Get(ctx, 130)
+	require.NoError(t, err)
+	require.Equal(t, hashes[131], h)
+	require.Nil(t, p.state, "served from disk, without running the VM")
+	h, err = p.Get(ctx, 125)
+	require.NoError(t, err)
+	require.Equal(t, hashes[126], h)
+	require.Equal(t, uint64(126), p.state.Step, "ran from the snapshot at 120")
+}
+
+func TestProviderExitAtFirstStep(t *testing.T) {
+	// a program that exits on its first step, so the last step of the trace is 0
+	prestate := fast.NewVMState()
+	prestate.PC = 0x1000
+	prestate.Memory.SetUnaligned(0x1000, []byte{0x73, 0, 0, 0}) // ecall
+	prestate.Registers[17] = 93                                 // exit
+	dir := t.TempDir()
+	p, err := NewProvider(log.New(), prestate, nil, Config{Dir: dir, CacheSize: 10})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	exited, err := p.Get(ctx, 1)
+	require.NoError(t, err)
+	for _, i := range []uint64{0, 1, 1 << 40} {
+		h, err := p.Get(ctx, i)
+		require.NoError(t, err)
+		require.Equal(t, exited, h, "post-state of step %d", i)
+	}
+	proofs, err := os.ReadDir(filepath.Join(dir, proofsDir))
+	require.NoError(t, err)
+	require.Len(t, proofs, 2, "steps past the exit are served by the proof of step 1")
+}